@@ -0,0 +1,173 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package ffa3
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+
+	"periph.io/x/conn/v3/physic"
+)
+
+// AnnotateOption is an option to AnnotatedSnapshot.
+type AnnotateOption func(o *annotateOptions)
+
+// WithOverlay selects what is drawn over the camera frame. By default, both
+// the temperatures and the job progress are drawn.
+func WithOverlay(temps, progress bool) AnnotateOption {
+	return func(o *annotateOptions) {
+		o.temps = temps
+		o.progress = progress
+	}
+}
+
+// WithOverlayScale sets the size of each font pixel, in image pixels. It
+// defaults to 2.
+func WithOverlayScale(n int) AnnotateOption {
+	return func(o *annotateOptions) {
+		o.scale = n
+	}
+}
+
+// AnnotatedSnapshot returns a camera frame with the current temperatures and
+// job progress drawn in the top left corner, for monitoring dashboards.
+//
+// The text looks like "E 210/210C B 60/60C" and "45% L 12/100".
+func (d *Dev) AnnotatedSnapshot(ctx context.Context, opts ...AnnotateOption) (image.Image, error) {
+	o := annotateOptions{temps: true, progress: true, scale: 2}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	b, err := d.Snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	img, err := jpeg.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("camera frame: %w", err)
+	}
+	var lines []string
+	if o.temps {
+		t := Temperatures{}
+		if err := d.QueryTemp(&t); err != nil {
+			return nil, err
+		}
+		lines = append(lines, formatTempsLine(&t))
+	}
+	if o.progress {
+		j := Job{}
+		if err := d.QueryJobStatus(&j); err != nil {
+			return nil, err
+		}
+		lines = append(lines, formatJobLine(&j))
+	}
+	return annotate(img, lines, o.scale), nil
+}
+
+// Internal
+
+// annotateOptions is the processed AnnotateOption list.
+type annotateOptions struct {
+	temps    bool
+	progress bool
+	scale    int
+}
+
+// formatTempsLine formats the temperatures for the overlay.
+func formatTempsLine(t *Temperatures) string {
+	s := "E " + formatOverlayTemp(t.Extruder, t.ExtruderTarget)
+	if t.Bed != 0 {
+		s += " B " + formatOverlayTemp(t.Bed, t.BedTarget)
+	}
+	if t.Chamber != 0 {
+		s += " C " + formatOverlayTemp(t.Chamber, t.ChamberTarget)
+	}
+	return s
+}
+
+func formatOverlayTemp(cur, target physic.Temperature) string {
+	if target == 0 {
+		return fmt.Sprintf("%.0fC", cur.Celsius())
+	}
+	return fmt.Sprintf("%.0f/%.0fC", cur.Celsius(), target.Celsius())
+}
+
+// formatJobLine formats the job progress for the overlay.
+func formatJobLine(j *Job) string {
+	pct := int64(0)
+	if j.Total > 0 {
+		pct = j.Printed * 100 / j.Total
+	}
+	return fmt.Sprintf("%d%% L %d/%d", pct, j.Layer, j.LayerTotal)
+}
+
+// annotate draws lines over a copy of img, in white over a translucent black
+// box.
+func annotate(img image.Image, lines []string, scale int) *image.RGBA {
+	b := img.Bounds()
+	dst := image.NewRGBA(b)
+	draw.Draw(dst, b, img, b.Min, draw.Src)
+	if len(lines) == 0 {
+		return dst
+	}
+	if scale < 1 {
+		scale = 1
+	}
+	const pad = 2
+	width := 0
+	for _, l := range lines {
+		if len(l) > width {
+			width = len(l)
+		}
+	}
+	// Each glyph is 5x7 with one pixel of spacing.
+	box := image.Rect(0, 0, (width*6+pad*2)*scale, (len(lines)*8+pad*2)*scale).Add(b.Min)
+	draw.Draw(dst, box, image.NewUniform(color.RGBA{0, 0, 0, 160}), image.Point{}, draw.Over)
+	white := image.NewUniform(color.White)
+	for y, l := range lines {
+		for x, c := range []byte(l) {
+			g := glyphs[c]
+			for row := 0; row < 7; row++ {
+				for col := 0; col < 5; col++ {
+					if g[row]&(0x10>>uint(col)) == 0 {
+						continue
+					}
+					p := image.Pt((pad+x*6+col)*scale, (pad+y*8+row)*scale).Add(b.Min)
+					draw.Draw(dst, image.Rectangle{p, p.Add(image.Pt(scale, scale))}, white, image.Point{}, draw.Src)
+				}
+			}
+		}
+	}
+	return dst
+}
+
+// glyphs is a 5x7 font covering the characters used in the overlay. Each row
+// is 5 bits, the most significant bit on the left. Other characters are blank.
+var glyphs = map[byte][7]uint8{
+	'0': {0x0E, 0x11, 0x13, 0x15, 0x19, 0x11, 0x0E},
+	'1': {0x04, 0x0C, 0x04, 0x04, 0x04, 0x04, 0x0E},
+	'2': {0x0E, 0x11, 0x01, 0x02, 0x04, 0x08, 0x1F},
+	'3': {0x1F, 0x02, 0x04, 0x02, 0x01, 0x11, 0x0E},
+	'4': {0x02, 0x06, 0x0A, 0x12, 0x1F, 0x02, 0x02},
+	'5': {0x1F, 0x10, 0x1E, 0x01, 0x01, 0x11, 0x0E},
+	'6': {0x06, 0x08, 0x10, 0x1E, 0x11, 0x11, 0x0E},
+	'7': {0x1F, 0x01, 0x02, 0x04, 0x08, 0x08, 0x08},
+	'8': {0x0E, 0x11, 0x11, 0x0E, 0x11, 0x11, 0x0E},
+	'9': {0x0E, 0x11, 0x11, 0x0F, 0x01, 0x02, 0x0C},
+	'B': {0x1E, 0x11, 0x11, 0x1E, 0x11, 0x11, 0x1E},
+	'C': {0x0E, 0x11, 0x10, 0x10, 0x10, 0x11, 0x0E},
+	'E': {0x1F, 0x10, 0x10, 0x1E, 0x10, 0x10, 0x1F},
+	'L': {0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x1F},
+	'%': {0x18, 0x19, 0x02, 0x04, 0x08, 0x13, 0x03},
+	'/': {0x00, 0x01, 0x02, 0x04, 0x08, 0x10, 0x00},
+	':': {0x00, 0x0C, 0x0C, 0x00, 0x0C, 0x0C, 0x00},
+	'.': {0x00, 0x00, 0x00, 0x00, 0x00, 0x0C, 0x0C},
+	'-': {0x00, 0x00, 0x00, 0x1F, 0x00, 0x00, 0x00},
+}
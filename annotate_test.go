@@ -0,0 +1,62 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package ffa3
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestFormatTempsLine(t *testing.T) {
+	data := []struct {
+		in   Temperatures
+		want string
+	}{
+		{Temperatures{Extruder: celsius(22)}, "E 22C"},
+		{Temperatures{Extruder: celsius(209.6), ExtruderTarget: celsius(210), Bed: celsius(60), BedTarget: celsius(60)}, "E 210/210C B 60/60C"},
+		{Temperatures{Extruder: celsius(22), Bed: celsius(17), Chamber: celsius(25), ChamberTarget: celsius(40)}, "E 22C B 17C C 25/40C"},
+	}
+	for i, line := range data {
+		if got := formatTempsLine(&line.in); got != line.want {
+			t.Fatalf("#%d: got %q, want %q", i, got, line.want)
+		}
+	}
+	if got := formatJobLine(&Job{Printed: 45, Total: 100, Layer: 12, LayerTotal: 100}); got != "45% L 12/100" {
+		t.Fatal(got)
+	}
+	if got := formatJobLine(&Job{}); got != "0% L 0/0" {
+		t.Fatal(got)
+	}
+}
+
+func TestAnnotate(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 100, 40))
+	for i := range src.Pix {
+		src.Pix[i] = 0x80
+	}
+	dst := annotate(src, []string{"E"}, 2)
+	if dst.Bounds() != src.Bounds() {
+		t.Fatal(dst.Bounds())
+	}
+	// The top left pixel of "E" is set, offset by the padding.
+	if got := dst.RGBAAt(4, 4); got != (color.RGBA{0xFF, 0xFF, 0xFF, 0xFF}) {
+		t.Fatal(got)
+	}
+	// The box is darker than the frame but doesn't cover the whole frame.
+	if got := dst.RGBAAt(14, 4); got.R >= 0x80 {
+		t.Fatal(got)
+	}
+	if got := dst.RGBAAt(50, 30); got.R != 0x80 {
+		t.Fatal(got)
+	}
+	// The source is not modified.
+	if src.Pix[0] != 0x80 {
+		t.Fatal("source was modified")
+	}
+	if got := annotate(src, nil, 2).RGBAAt(4, 4); got.R != 0x80 {
+		t.Fatal(got)
+	}
+}
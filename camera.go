@@ -0,0 +1,71 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package ffa3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// ErrCameraUnavailable is returned when the camera stream is not served, e.g.
+// because it is disabled in the printer settings.
+var ErrCameraUnavailable = errors.New("camera stream unavailable; enable it in the printer settings")
+
+// Snapshot returns a JPEG frame from the printer's camera.
+//
+// It reads the first frame of the MJPEG stream. It returns an
+// ErrCameraUnavailable wrapped error when the printer refuses the connection.
+func (d *Dev) Snapshot(ctx context.Context) ([]byte, error) {
+	c, ok := d.conn.(net.Conn)
+	if !ok {
+		return nil, errors.New("camera requires a network connection")
+	}
+	host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		return nil, err
+	}
+	return snapshot(ctx, "http://"+net.JoinHostPort(host, "8080")+"/?action=stream")
+}
+
+// Internal
+
+// snapshot reads the first frame of the MJPEG stream at url.
+func snapshot(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, fmt.Errorf("%w: %v", ErrCameraUnavailable, err)
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("camera stream: %s", resp.Status)
+	}
+	// "multipart/x-mixed-replace;boundary=boundarydonotcross"
+	mt, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("camera stream: %w", err)
+	}
+	if mt != "multipart/x-mixed-replace" || params["boundary"] == "" {
+		return nil, fmt.Errorf("camera stream: unexpected content type %q", mt)
+	}
+	p, err := multipart.NewReader(resp.Body, params["boundary"]).NextPart()
+	if err != nil {
+		return nil, fmt.Errorf("camera stream: %w", err)
+	}
+	return ioutil.ReadAll(p)
+}
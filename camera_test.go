@@ -0,0 +1,81 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package ffa3
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace;boundary=boundarydonotcross")
+		w.Write([]byte("--boundarydonotcross\r\nContent-Type: image/jpeg\r\n\r\nframe1\r\n--boundarydonotcross\r\nContent-Type: image/jpeg\r\n\r\nframe2\r\n"))
+	}))
+	defer s.Close()
+	b, err := snapshot(context.Background(), s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "frame1" {
+		t.Fatalf("unexpected %q", b)
+	}
+}
+
+func TestSnapshot_Invalid(t *testing.T) {
+	data := []func(w http.ResponseWriter){
+		func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusNotFound)
+		},
+		func(w http.ResponseWriter) {
+			w.Header().Set("Content-Type", "image/jpeg")
+		},
+		func(w http.ResponseWriter) {
+			w.Header().Set("Content-Type", "multipart/x-mixed-replace;boundary=b")
+		},
+	}
+	for i, f := range data {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			f(w)
+		}))
+		_, err := snapshot(context.Background(), s.URL)
+		s.Close()
+		if err == nil {
+			t.Fatalf("#%d: expected error", i)
+		}
+	}
+}
+
+func TestSnapshot_Refused(t *testing.T) {
+	// Grab a free port and close it so nothing listens there.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	if _, err := snapshot(context.Background(), "http://"+addr+"/?action=stream"); !errors.Is(err, ErrCameraUnavailable) {
+		t.Fatal(err)
+	}
+	// Other errors are not the camera being disabled.
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer s.Close()
+	if _, err := snapshot(context.Background(), s.URL); err == nil || errors.Is(err, ErrCameraUnavailable) {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshot_NotNetwork(t *testing.T) {
+	d := &Dev{conn: &failingConn{written: make(chan struct{})}}
+	if _, err := d.Snapshot(context.Background()); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -5,106 +5,269 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"sort"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/maruel/ffa3"
 )
 
-func play(d *ffa3.Dev) error {
-	i := ffa3.Info{}
-	if err := d.QueryPrinterInfo(&i); err != nil {
-		return err
-	}
-	fmt.Printf("Printer info: %# v\n", i)
+const usage = `usage: ffa3 [flags] <command> [args]
 
-	p := ffa3.Position{}
-	if err := d.QueryExtruderPosition(&p); err != nil {
-		return err
-	}
-	fmt.Printf("Extruder position: %# v\n", p)
+Commands:
+  discover          lists the name, model, serial number and IP of the
+                    printers found on the network
+  info              prints the printer information
+  temp              prints the temperatures
+  status            prints the printer and job status
+  light <on|off|r,g,b>
+                    turns the light on or off or sets its color, e.g. 255,128,0
+  print <file>      uploads a G-code file and prints it
+  stop              stops the running job
+  snapshot <file>   saves a camera frame as a JPEG file
+  watch             prints the temperatures and job progress until Ctrl-C
 
-	s := ffa3.Status{}
-	if err := d.QueryStatus(&s); err != nil {
-		return err
-	}
-	fmt.Printf("Status: %# v\n", s)
+Flags:
+`
 
-	t := ffa3.Temperatures{}
-	if err := d.QueryTemp(&t); err != nil {
-		return err
+// command is a parsed subcommand.
+type command struct {
+	name string
+	args []string
+}
+
+// parseCommand parses and validates the subcommand arguments.
+func parseCommand(args []string) (command, error) {
+	if len(args) == 0 {
+		return command{}, errors.New("specify a command")
+	}
+	c := command{name: args[0], args: args[1:]}
+	want := 0
+	switch c.name {
+	case "discover", "info", "temp", "status", "stop", "watch":
+	case "light":
+		want = 1
+		if len(c.args) == 1 {
+			if _, err := parseLight(c.args[0]); err != nil {
+				return c, err
+			}
+		}
+	case "print", "snapshot":
+		want = 1
+	default:
+		return c, fmt.Errorf("unknown command %q", c.name)
 	}
-	fmt.Printf("Temperatures: %# v\n", t)
+	if len(c.args) != want {
+		return c, fmt.Errorf("%s: expected %d argument(s), got %d", c.name, want, len(c.args))
+	}
+	return c, nil
+}
 
-	j, err := d.QueryJobStatus()
-	if err != nil {
-		return err
+// parseLight parses "on", "off" or a "r,g,b" triple.
+func parseLight(arg string) ([3]uint8, error) {
+	switch arg {
+	case "on":
+		return [3]uint8{255, 255, 255}, nil
+	case "off":
+		return [3]uint8{}, nil
 	}
-	fmt.Printf("Job: %s\n", j)
+	var rgb [3]uint8
+	parts := strings.Split(arg, ",")
+	if len(parts) != 3 {
+		return rgb, fmt.Errorf("light: invalid argument %q; use on, off or r,g,b", arg)
+	}
+	for i, p := range parts {
+		v, err := strconv.ParseUint(strings.TrimSpace(p), 10, 8)
+		if err != nil {
+			return rgb, fmt.Errorf("light: invalid color %q; each channel must be between 0 and 255", arg)
+		}
+		rgb[i] = uint8(v)
+	}
+	return rgb, nil
+}
 
-	if err := d.StopJob(); err != nil {
-		return err
+// printerInfo is a printer found on the network, along its information when
+// it could be queried.
+type printerInfo struct {
+	ffa3.Found
+	model  string
+	serial string
+}
+
+// queryFound connects to each printer found to get its model and serial
+// number.
+//
+// It connects in read-only mode so a client in control of the printer is not
+// disturbed. A printer that can't be queried is still listed.
+func queryFound(ctx context.Context, f []ffa3.Found) []printerInfo {
+	out := make([]printerInfo, len(f))
+	var wg sync.WaitGroup
+	for i := range f {
+		out[i].Found = f[i]
+		wg.Add(1)
+		go func(p *printerInfo) {
+			defer wg.Done()
+			d, err := ffa3.TryConnect(ctx, p.IP.String(), ffa3.WithReadOnly())
+			if err != nil {
+				log.Printf("%s: %s", p.String(), err)
+				return
+			}
+			defer d.Close()
+			i := ffa3.Info{}
+			if err := d.QueryPrinterInfo(&i); err != nil {
+				log.Printf("%s: %s", p.String(), err)
+				return
+			}
+			if p.model = d.Capabilities().Model; p.model == "" {
+				p.model = i.Type
+			}
+			p.serial = i.Serial
+		}(&out[i])
 	}
+	wg.Wait()
+	return out
+}
 
-	resp, err := d.SendRawCommand("G28")
-	fmt.Printf("Response: %q\n", resp)
-	fmt.Printf("Err: %v\n", err)
+// formatFound formats the printers found, one per line, sorted by name.
+//
+// The model and serial number are "?" when unknown.
+func formatFound(p []printerInfo) string {
+	f := make([]ffa3.Found, len(p))
+	byKey := map[string]printerInfo{}
+	for i := range p {
+		f[i] = p[i].Found
+		byKey[p[i].String()] = p[i]
+	}
+	ffa3.SortFound(f)
+	out := ""
+	for _, l := range f {
+		i := byKey[l.String()]
+		model, serial := i.model, i.serial
+		if model == "" {
+			model = "?"
+		}
+		if serial == "" {
+			serial = "?"
+		}
+		out += fmt.Sprintf("%-20s %-20s %-16s %s\n", l.Name, model, serial, l.IP)
+	}
+	return out
+}
 
-	/*
-		fmt.Printf("LED off\n")
-		if err := d.SetLight(false); err != nil {
+func run(ctx context.Context, d *ffa3.Dev, c command) error {
+	switch c.name {
+	case "info":
+		i := ffa3.Info{}
+		if err := d.QueryPrinterInfo(&i); err != nil {
 			return err
 		}
-		time.Sleep(time.Second)
-
-		fmt.Printf("LED on\n")
-		if err := d.SetLight(true); err != nil {
+		fmt.Printf("Printer info: %# v\n", i)
+	case "temp":
+		t := ffa3.Temperatures{}
+		if err := d.QueryTemp(&t); err != nil {
 			return err
 		}
-		time.Sleep(time.Second)
-	*/
-
-	/*
-		fmt.Printf("Fan off\n")
-		if err := d.SetFan(false); err != nil {
+		fmt.Printf("Temperatures: %# v\n", t)
+	case "status":
+		s := ffa3.Status{}
+		if err := d.QueryStatus(&s); err != nil {
 			return err
 		}
-		time.Sleep(time.Second)
-
-		fmt.Printf("Fan on\n")
-		if err := d.SetFan(true); err != nil {
+		fmt.Printf("Status: %# v\n", s)
+		j := ffa3.Job{}
+		if err := d.QueryJobStatus(&j); err != nil {
 			return err
 		}
-		time.Sleep(4 * time.Second)
-
-		fmt.Printf("Fan off\n")
-		if err := d.SetFan(false); err != nil {
+		fmt.Printf("Job: %# v\n", j)
+	case "light":
+		rgb, _ := parseLight(c.args[0])
+		return d.SetLightColor(rgb[0], rgb[1], rgb[2])
+	case "print":
+		return d.PrintFile(ctx, c.args[0], ffa3.WithProgress(func(sent, total int64) {
+			fmt.Printf("\rUploading: %d/%d", sent, total)
+			if sent == total {
+				fmt.Printf("\n")
+			}
+		}))
+	case "stop":
+		return d.StopJob()
+	case "snapshot":
+		b, err := d.Snapshot(ctx)
+		if err != nil {
 			return err
 		}
-		time.Sleep(time.Second)
-	*/
+		return ioutil.WriteFile(c.args[0], b, 0o644)
+	case "watch":
+		return watch(ctx, d, time.Second)
+	}
 	return nil
 }
 
+// watch prints a refreshing status line until ctx is canceled.
+func watch(ctx context.Context, d *ffa3.Dev, every time.Duration) error {
+	defer fmt.Printf("\n")
+	for {
+		t := ffa3.Temperatures{}
+		if err := d.QueryTemp(&t); err != nil {
+			return err
+		}
+		j := ffa3.Job{}
+		if err := d.QueryJobStatus(&j); err != nil {
+			return err
+		}
+		fmt.Printf("\rExtruder: %-8s Bed: %-8s Progress: %d/%d Layer: %d/%d ", t.Extruder, t.Bed, j.Printed, j.Total, j.Layer, j.LayerTotal)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(every):
+		}
+	}
+}
+
 func mainImpl() error {
-	ip := flag.String("ip", "", "Printer IP; by default a search is done but it takes one second")
+	ip := flag.String("ip", "", "Printer IP; by default a search is done, waiting up to -timeout for a printer to reply")
+	timeout := flag.Duration("timeout", time.Second, "Time to wait for printers to reply to the search")
 	verbose := flag.Bool("v", false, "verbose")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 	if !*verbose {
 		log.SetOutput(ioutil.Discard)
 	} else {
 		log.SetFlags(log.Lmicroseconds)
 	}
+	c, err := parseCommand(flag.Args())
+	if err != nil {
+		flag.Usage()
+		return err
+	}
+
+	if c.name == "discover" {
+		f, err := ffa3.Search(false, *timeout)
+		if err != nil {
+			return err
+		}
+		if len(f) == 0 {
+			return errors.New("no printer found on network")
+		}
+		// The discovery reply only contains the printer name.
+		fmt.Print(formatFound(queryFound(context.Background(), f)))
+		return nil
+	}
 
 	if *ip == "" {
-		f, err := ffa3.Search(true, time.Second)
+		f, err := ffa3.Search(true, *timeout)
 		if err != nil {
 			return err
 		}
@@ -114,22 +277,35 @@ func mainImpl() error {
 		// This will not happen since we specify first=true above. Leaving
 		// the code as a safety gap in case I want to change first flag above.
 		if len(f) > 1 {
+			ffa3.SortFound(f)
 			var s []string
 			for _, l := range f {
 				s = append(s, "- "+l.String())
 			}
-			sort.Strings(s)
-			return fmt.Errorf("more than one printer found on network; specify which one you want:\n%s", strings.Join(s, "\n"))
+			return fmt.Errorf("more than one printer found on network; specify which one you want with -ip:\n%s", strings.Join(s, "\n"))
 		}
 		log.Printf("Using printer: %s", f[0].String())
 		*ip = f[0].IP.String()
 	}
 
-	d, err := ffa3.Connect(*ip)
+	// Cancel on Ctrl-C so the printer is released cleanly.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt)
+	defer signal.Stop(ch)
+	go func() {
+		select {
+		case <-ch:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	d, err := ffa3.ConnectContext(ctx, *ip)
 	if err != nil {
 		return err
 	}
-	err = play(d)
+	err = run(ctx, d, c)
 	if err2 := d.Close(); err == nil {
 		err = err2
 	}
@@ -0,0 +1,160 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maruel/ffa3"
+)
+
+func TestParseCommand(t *testing.T) {
+	data := []struct {
+		in   []string
+		want command
+		err  bool
+	}{
+		{in: []string{"info"}, want: command{name: "info", args: []string{}}},
+		{in: []string{"light", "on"}, want: command{name: "light", args: []string{"on"}}},
+		{in: []string{"light", "off"}, want: command{name: "light", args: []string{"off"}}},
+		{in: []string{"print", "a.gx"}, want: command{name: "print", args: []string{"a.gx"}}},
+		{in: []string{"watch"}, want: command{name: "watch", args: []string{}}},
+		{in: []string{"discover"}, want: command{name: "discover", args: []string{}}},
+		{in: nil, err: true},
+		{in: []string{"fly"}, err: true},
+		{in: []string{"info", "extra"}, err: true},
+		{in: []string{"light"}, err: true},
+		{in: []string{"light", "255,128,0"}, want: command{name: "light", args: []string{"255,128,0"}}},
+		{in: []string{"light", "dim"}, err: true},
+		{in: []string{"light", "256,0,0"}, err: true},
+		{in: []string{"light", "on", "off"}, err: true},
+		{in: []string{"snapshot"}, err: true},
+	}
+	for i, line := range data {
+		got, err := parseCommand(line.in)
+		if (err != nil) != line.err {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if err == nil && !reflect.DeepEqual(got, line.want) {
+			t.Fatalf("#%d: got %+v, want %+v", i, got, line.want)
+		}
+	}
+}
+
+func TestParseLight(t *testing.T) {
+	data := []struct {
+		in   string
+		want [3]uint8
+		err  bool
+	}{
+		{in: "on", want: [3]uint8{255, 255, 255}},
+		{in: "off", want: [3]uint8{}},
+		{in: "255,128,0", want: [3]uint8{255, 128, 0}},
+		{in: "1, 2, 3", want: [3]uint8{1, 2, 3}},
+		{in: "256,0,0", err: true},
+		{in: "-1,0,0", err: true},
+		{in: "1,2", err: true},
+		{in: "1,2,3,4", err: true},
+		{in: "dim", err: true},
+	}
+	for i, line := range data {
+		got, err := parseLight(line.in)
+		if (err != nil) != line.err {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if err == nil && got != line.want {
+			t.Fatalf("#%d: got %v, want %v", i, got, line.want)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	d := newFakeDev(t, map[string]string{"M27": "SD printing byte 10/100"})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// It returns cleanly once canceled, after one refresh.
+	if err := watch(ctx, d, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+	if err := watch(context.Background(), d, time.Millisecond); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestFormatFound(t *testing.T) {
+	p := []printerInfo{
+		{Found: ffa3.Found{Name: "shop", IP: net.ParseIP("10.0.0.3")}, model: "Adventurer 3", serial: "SNADVA1"},
+		{Found: ffa3.Found{Name: "garage", IP: net.ParseIP("10.0.0.9")}},
+		{Found: ffa3.Found{Name: "shop", IP: net.ParseIP("10.0.0.2")}, model: "Adventurer 4"},
+	}
+	// The printers that couldn't be queried get placeholders.
+	want := "" +
+		"garage               ?                    ?                10.0.0.9\n" +
+		"shop                 Adventurer 4         ?                10.0.0.2\n" +
+		"shop                 Adventurer 3         SNADVA1          10.0.0.3\n"
+	if got := formatFound(p); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	// The input is not modified.
+	if p[0].Name != "shop" || !p[0].IP.Equal(net.ParseIP("10.0.0.3")) {
+		t.Fatalf("modified %v", p)
+	}
+}
+
+func TestQueryFound_Unreachable(t *testing.T) {
+	// Nothing listens there; the printer is still listed.
+	f := []ffa3.Found{{Name: "shop", IP: net.ParseIP("127.0.0.2")}}
+	got := queryFound(context.Background(), f)
+	if len(got) != 1 || got[0].Name != "shop" || got[0].model != "" || got[0].serial != "" {
+		t.Fatalf("unexpected %+v", got)
+	}
+}
+
+//
+
+// newFakeDev returns a Dev connected to a fake printer replying with the
+// bodies in replies, by command code.
+func newFakeDev(t *testing.T, replies map[string]string) *ffa3.Dev {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	defaults := map[string]string{
+		"M601": "Control Success.",
+		"M602": "Control Release.",
+		"M105": "T0:22 /0 B:17/0",
+	}
+	for k, v := range replies {
+		defaults[k] = v
+	}
+	go func() {
+		r := bufio.NewReader(server)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			code := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(line, "~")), " ", 2)[0]
+			body := defaults[code]
+			if body != "" {
+				body += "\r\n"
+			}
+			server.Write([]byte("CMD " + code + " Received.\r\n" + body + "ok\r\n"))
+		}
+	}()
+	d, err := ffa3.NewDev(context.Background(), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
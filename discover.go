@@ -0,0 +1,351 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package ffa3
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Found is a printer found on the network.
+type Found struct {
+	IP   net.IP
+	Name string
+	// LastSeen is when the printer last replied.
+	LastSeen time.Time
+	// Update is true when the printer was already sent by Discover and only
+	// LastSeen changed.
+	Update bool
+	_      struct{}
+}
+
+func (f *Found) String() string {
+	return fmt.Sprintf("%s (%s)", f.Name, f.IP)
+}
+
+// SortFound sorts the printers found by name, then by IP, for a deterministic
+// output.
+func SortFound(f []Found) {
+	sort.SliceStable(f, func(i, j int) bool {
+		if f[i].Name != f[j].Name {
+			return f[i].Name < f[j].Name
+		}
+		return bytes.Compare(f[i].IP.To16(), f[j].IP.To16()) < 0
+	})
+}
+
+// DiscoverOption is an option to Search and Discover.
+type DiscoverOption func(o *discoverOptions)
+
+// WithPacketConn makes the discovery use c instead of listening on a new UDP
+// socket.
+//
+// c is not closed when the discovery is done.
+func WithPacketConn(c net.PacketConn) DiscoverOption {
+	return func(o *discoverOptions) {
+		o.conn = c
+	}
+}
+
+// WithIPv6 makes the discovery use the IPv6 all-nodes link-local multicast
+// group on the network interface iface, e.g. "eth0", instead of the IPv4
+// multicast group.
+//
+// The group is link-local so the interface is required. The firmware is not
+// known to reply over IPv6; this is experimental.
+func WithIPv6(iface string) DiscoverOption {
+	return func(o *discoverOptions) {
+		o.ipv6 = true
+		o.iface = iface
+	}
+}
+
+// WithIgnoredCount makes the discovery count in n the replies ignored because
+// they don't look like a printer's, e.g. from another device listening on the
+// discovery port.
+//
+// n is updated atomically.
+func WithIgnoredCount(n *int64) DiscoverOption {
+	return func(o *discoverOptions) {
+		o.ignored = n
+	}
+}
+
+// Search searches for printers via UDP discovery.
+//
+// It does so by sending bytes to a predetermined multicast IP address.
+func Search(first bool, d time.Duration, opts ...DiscoverOption) ([]Found, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	c, err := Discover(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	var out []Found
+	index := map[string]int{}
+	for f := range c {
+		if f.Update {
+			out[index[f.String()]].LastSeen = f.LastSeen
+			continue
+		}
+		index[f.String()] = len(out)
+		out = append(out, f)
+		if first {
+			cancel()
+			for range c {
+			}
+		}
+	}
+	return out, nil
+}
+
+// Discover searches for printers via UDP discovery until ctx is done.
+//
+// Each printer is sent once as it first replies. When it replies again, it is
+// sent as an update, with Update set and LastSeen refreshed, at most every
+// discoverRefresh so stale printers can be aged out. Found.String() identifies
+// the printer. The channel is closed once ctx is done.
+func Discover(ctx context.Context, opts ...DiscoverOption) (<-chan Found, error) {
+	o := discoverOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.ipv6 && o.iface == "" {
+		return nil, errors.New("IPv6 discovery requires a network interface")
+	}
+	network, ip := o.group()
+	raddr, err := net.ResolveUDPAddr(network, ip)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", ip, err)
+	}
+
+	l := o.conn
+	if l == nil {
+		// In practice we'd want to specify the right IP here, because otherwise
+		// laddr is set to 0.0.0.0. In practice it seems to work anyway.
+		// May want to revisit later.
+		u, err := net.ListenUDP(network, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed listening to UDP: %w", err)
+		}
+		u.SetReadBuffer(1024)
+		l = u
+	}
+	closeConn := func() {
+		if o.conn == nil {
+			l.Close()
+		}
+	}
+	log.Printf("Listening on: %s", l.LocalAddr())
+
+	// It seems that the content is ignored in practice, and that the printer
+	// replies to the UDP packet origin IP:port anyway.
+	magic := [8]byte{}
+	if laddr, ok := l.LocalAddr().(*net.UDPAddr); ok {
+		copy(magic[:4], laddr.IP.To4())
+		binary.BigEndian.PutUint16(magic[4:], uint16(laddr.Port))
+	}
+	log.Printf("Magic: %x", magic)
+	// Bound the write so a hung network interface doesn't block forever.
+	deadline, ok := ctx.Deadline()
+	if !ok || time.Until(deadline) > discoverWriteTimeout {
+		deadline = time.Now().Add(discoverWriteTimeout)
+	}
+	l.SetWriteDeadline(deadline)
+	_, err = l.WriteTo(magic[:], raddr)
+	l.SetWriteDeadline(time.Time{})
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		closeConn()
+		return nil, fmt.Errorf("failed to write magic packet: %w", err)
+	}
+
+	// Read loop.
+	out := make(chan Found)
+	go func() {
+		defer close(out)
+		defer closeConn()
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		defer func() {
+			close(stop)
+			<-done
+			l.SetReadDeadline(time.Time{})
+		}()
+		go func() {
+			defer close(done)
+			select {
+			case <-ctx.Done():
+				// Unblock ReadFrom right away.
+				l.SetReadDeadline(time.Unix(1, 0))
+			case <-stop:
+			}
+		}()
+		// seen is when each printer was last sent.
+		seen := map[string]time.Time{}
+		b := [1024]byte{}
+		for {
+			n, src, err := l.ReadFrom(b[:])
+			log.Printf("ReadFrom() = %v, %v, %v", n, src, err)
+			if err != nil {
+				// Ignore read errors since it'll fail when the connection is closed.
+				return
+			}
+			name, ok := parseFound(b[:n])
+			if !ok {
+				log.Printf("Ignoring reply from %s: %q", src, b[:n])
+				if o.ignored != nil {
+					atomic.AddInt64(o.ignored, 1)
+				}
+				continue
+			}
+			f := Found{IP: addrIP(src), Name: name, LastSeen: time.Now()}
+			k := f.String()
+			last, ok := seen[k]
+			if ok && f.LastSeen.Sub(last) < discoverRefresh {
+				continue
+			}
+			seen[k] = f.LastSeen
+			f.Update = ok
+			select {
+			case out <- f:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// DiscoverAndConnectAll discovers the printers on the network and connects to
+// each of them concurrently.
+//
+// It returns the printers successfully connected to, along with an error
+// combining the failures. If ctx is canceled, the printers connected to are
+// closed and only ctx's error is returned.
+func DiscoverAndConnectAll(ctx context.Context, opts ...Option) ([]*Dev, error) {
+	dctx, cancel := context.WithTimeout(ctx, discoverAllTimeout)
+	defer cancel()
+	c, err := Discover(dctx)
+	if err != nil {
+		return nil, err
+	}
+	var found []Found
+	for f := range c {
+		if !f.Update {
+			found = append(found, f)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var devs []*Dev
+	var errs []string
+	for _, f := range found {
+		wg.Add(1)
+		go func(f Found) {
+			defer wg.Done()
+			d, err := ConnectContext(ctx, f.IP.String(), opts...)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s", f.String(), err))
+				return
+			}
+			devs = append(devs, d)
+		}(f)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		for _, d := range devs {
+			d.Close()
+		}
+		return nil, err
+	}
+	if len(errs) != 0 {
+		sort.Strings(errs)
+		return devs, fmt.Errorf("failed to connect to %d printer(s): %s", len(errs), strings.Join(errs, "; "))
+	}
+	return devs, nil
+}
+
+// Internal
+
+// discoverAllTimeout is the time DiscoverAndConnectAll waits for printers to
+// reply.
+const discoverAllTimeout = time.Second
+
+// discoverRefresh is the minimum interval between the updates Discover sends
+// for a printer replying repeatedly.
+const discoverRefresh = time.Second
+
+// discoverWriteTimeout is the maximum time to send the magic packet.
+const discoverWriteTimeout = time.Second
+
+// discoverOptions is the processed DiscoverOption list.
+type discoverOptions struct {
+	conn    net.PacketConn
+	ipv6    bool
+	iface   string
+	ignored *int64
+}
+
+// group returns the network and the multicast address to send the magic
+// packet to.
+func (o *discoverOptions) group() (string, string) {
+	if o.ipv6 {
+		return "udp6", net.JoinHostPort("ff02::1%"+o.iface, "19000")
+	}
+	// Magic multicast IP the FlashForge Adventurer 3 is listening to.
+	return "udp4", "225.0.0.9:19000"
+}
+
+// parseFound returns the printer name from a discovery reply.
+//
+// The name is in a NUL padded fixed-width field. It is trimmed and invalid
+// UTF-8 is replaced so it is always a clean display string. It returns false
+// if the payload doesn't look like a printer's: the name must be non-empty,
+// NUL terminated and without control characters.
+func parseFound(b []byte) (string, bool) {
+	// TODO(maruel): It's a 140 bytes packet. Figure out the rest of the format.
+	i := bytes.IndexByte(b, 0)
+	if i == -1 {
+		return "", false
+	}
+	for _, c := range b[:i] {
+		if c < 0x20 || c == 0x7f {
+			return "", false
+		}
+	}
+	name := strings.TrimSpace(strings.ToValidUTF8(string(b[:i]), "\uFFFD"))
+	return name, name != ""
+}
+
+// addrIP returns the IP of a packet source address.
+func addrIP(a net.Addr) net.IP {
+	if u, ok := a.(*net.UDPAddr); ok {
+		return u.IP
+	}
+	host, _, err := net.SplitHostPort(a.String())
+	if err != nil {
+		host = a.String()
+	}
+	return net.ParseIP(host)
+}
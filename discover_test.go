@@ -0,0 +1,393 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package ffa3
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDiscover(t *testing.T) {
+	multicastResponder(t, "fake\x00", "fake\x00", "fake\x00", "no terminator")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := Discover(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []Found
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		cancel()
+	}()
+	for f := range c {
+		if f.Name == "fake" {
+			got = append(got, f)
+		}
+	}
+	// The repeated replies are deduplicated.
+	if len(got) != 1 || got[0].Update {
+		t.Fatalf("unexpected %v", got)
+	}
+	if ctx.Err() != context.Canceled {
+		t.Fatal("channel closed before ctx was done")
+	}
+}
+
+func TestDiscoverAndConnectAll(t *testing.T) {
+	// The printer replies to the discovery but doesn't accept connections.
+	multicastResponder(t, "fake\x00", "fake\x00")
+	devs, err := DiscoverAndConnectAll(context.Background(), WithDialTimeout(time.Second))
+	if len(devs) != 0 {
+		t.Fatalf("unexpected %v", devs)
+	}
+	// The printer is only tried once.
+	if err == nil || !strings.HasPrefix(err.Error(), "failed to connect to 1 printer(s): fake (") {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if devs, err := DiscoverAndConnectAll(ctx); len(devs) != 0 || !errors.Is(err, context.Canceled) {
+		t.Fatal(devs, err)
+	}
+}
+
+func TestDiscover_PacketConn(t *testing.T) {
+	c := newFakePacketConn(fakePacket{"fake\x00", "10.0.0.2"}, fakePacket{"other\x00", "10.0.0.3"}, fakePacket{"fake\x00", "10.0.0.2"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := Discover(ctx, WithPacketConn(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for f := range ch {
+		if got = append(got, f.String()); len(got) == 2 {
+			cancel()
+		}
+	}
+	if want := []string{"fake (10.0.0.2)", "other (10.0.0.3)"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if c.written() != 1 {
+		t.Fatal(c.written())
+	}
+	if c.isClosed() {
+		t.Fatal("the caller's conn must not be closed")
+	}
+}
+
+func TestDiscover_Ignored(t *testing.T) {
+	c := newFakePacketConn(fakePacket{"\x00", "10.0.0.4"}, fakePacket{"junk\x01\x00", "10.0.0.5"}, fakePacket{"fake\x00", "10.0.0.2"})
+	var n int64
+	got, err := Search(true, 10*time.Second, WithPacketConn(c), WithIgnoredCount(&n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Name != "fake" {
+		t.Fatalf("unexpected %v", got)
+	}
+	if atomic.LoadInt64(&n) != 2 {
+		t.Fatal(n)
+	}
+}
+
+func TestParseFound(t *testing.T) {
+	data := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"fake\x00\x01\x02", "fake", true},
+		{"My Printer\x00", "My Printer", true},
+		{"\x00", "", false},
+		{"no terminator", "", false},
+		{"caf\xc3\xa9\x00", "caf\u00e9", true},
+		{"  padded \x00\x00\x00", "padded", true},
+		{"bad\xff\x00", "bad\uFFFD", true},
+		{"   \x00", "", false},
+		{"tab\t\x00", "", false},
+		{"del\x7f\x00", "", false},
+	}
+	for i, line := range data {
+		if name, ok := parseFound([]byte(line.in)); name != line.want || ok != line.ok {
+			t.Fatalf("#%d: got %q %t", i, name, ok)
+		}
+	}
+}
+
+func TestSortFound(t *testing.T) {
+	f := []Found{
+		{Name: "b", IP: net.IPv4(10, 0, 0, 1)},
+		{Name: "a", IP: net.IPv4(10, 0, 0, 10)},
+		{Name: "a", IP: net.IPv4(10, 0, 0, 9)},
+		{Name: "a", IP: net.ParseIP("fe80::1")},
+	}
+	SortFound(f)
+	var got []string
+	for _, l := range f {
+		got = append(got, l.String())
+	}
+	// IPs are compared numerically, not as strings.
+	if want := []string{"a (10.0.0.9)", "a (10.0.0.10)", "a (fe80::1)", "b (10.0.0.1)"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestSearch_PacketConn(t *testing.T) {
+	c := newFakePacketConn(fakePacket{"fake\x00", "10.0.0.2"}, fakePacket{"other\x00", "10.0.0.3"})
+	got, err := Search(true, 10*time.Second, WithPacketConn(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Name != "fake" || !got[0].IP.Equal(net.IPv4(10, 0, 0, 2)) {
+		t.Fatalf("unexpected %v", got)
+	}
+}
+
+func TestSearch_Fast(t *testing.T) {
+	c := newFakePacketConn(fakePacket{"fake\x00", "10.0.0.2"})
+	start := time.Now()
+	got, err := Search(true, time.Second, WithPacketConn(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("took %s", d)
+	}
+	if len(got) != 1 {
+		t.Fatalf("unexpected %v", got)
+	}
+}
+
+func TestSearch_BackToBack(t *testing.T) {
+	// A discovery right after another one must not fail binding its socket.
+	multicastResponder(t, "fake\x00")
+	for i := 0; i < 2; i++ {
+		got, err := Search(true, 5*time.Second)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if len(got) != 1 || got[0].Name != "fake" {
+			t.Fatalf("#%d: unexpected %v", i, got)
+		}
+	}
+}
+
+func TestDiscover_IPv6(t *testing.T) {
+	c := newFakePacketConn(fakePacket{"fake\x00", "fe80::1"})
+	got, err := Search(true, time.Second, WithPacketConn(c), WithIPv6("eth0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || !got[0].IP.Equal(net.ParseIP("fe80::1")) {
+		t.Fatalf("unexpected %v", got)
+	}
+	c.mu.Lock()
+	dst := c.dst.String()
+	c.mu.Unlock()
+	// The link-local group is scoped to the interface.
+	if dst != "[ff02::1%eth0]:19000" {
+		t.Fatal(dst)
+	}
+	if _, err := Search(true, time.Second, WithPacketConn(newFakePacketConn()), WithIPv6("")); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestDiscover_WriteTimeout(t *testing.T) {
+	c := newFakePacketConn()
+	c.hang = true
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := Discover(ctx, WithPacketConn(c)); err == nil {
+		t.Fatal("expected error")
+	}
+	if d := time.Since(start); d > discoverWriteTimeout {
+		t.Fatalf("took %s", d)
+	}
+}
+
+func TestSearch_LastSeen(t *testing.T) {
+	c := newFakePacketConn(fakePacket{"fake\x00", "10.0.0.2"}, fakePacket{"other\x00", "10.0.0.3"}, fakePacket{"fake\x00", "10.0.0.2"})
+	got, err := Search(false, 100*time.Millisecond, WithPacketConn(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each printer is listed once. The repeated reply is too soon to be an
+	// update.
+	if len(got) != 2 || got[0].Name != "fake" || got[1].Name != "other" {
+		t.Fatalf("unexpected %v", got)
+	}
+	if got[0].LastSeen.After(got[1].LastSeen) {
+		t.Fatalf("LastSeen was refreshed: %v", got)
+	}
+}
+
+func TestDiscover_Update(t *testing.T) {
+	c := newFakePacketConn(fakePacket{"fake\x00", "10.0.0.2"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := Discover(ctx, WithPacketConn(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(discoverRefresh + 50*time.Millisecond)
+		c.ch <- fakePacket{"fake\x00", "10.0.0.2"}
+	}()
+	var got []Found
+	for f := range ch {
+		if got = append(got, f); len(got) == 2 {
+			cancel()
+		}
+	}
+	// The printer replying again after discoverRefresh is sent as an update.
+	if len(got) != 2 || got[0].Update || !got[1].Update || !got[1].LastSeen.After(got[0].LastSeen) {
+		t.Fatalf("unexpected %v", got)
+	}
+}
+
+//
+
+// fakePacket is a discovery reply.
+type fakePacket struct {
+	payload string
+	ip      string
+}
+
+// fakePacketConn is a net.PacketConn receiving the replies once the magic
+// packet is written.
+type fakePacketConn struct {
+	replies []fakePacket
+	ch      chan fakePacket
+
+	// hang makes WriteTo block until the write deadline.
+	hang bool
+
+	mu       sync.Mutex
+	writes   int
+	dst      net.Addr
+	wdl      time.Time
+	closed   bool
+	deadline time.Time
+}
+
+func newFakePacketConn(replies ...fakePacket) *fakePacketConn {
+	return &fakePacketConn{replies: replies, ch: make(chan fakePacket, len(replies))}
+}
+
+func (f *fakePacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		f.mu.Lock()
+		d := f.deadline
+		f.mu.Unlock()
+		if !d.IsZero() && time.Now().After(d) {
+			return 0, nil, errors.New("i/o timeout")
+		}
+		select {
+		case p := <-f.ch:
+			return copy(b, p.payload), &net.UDPAddr{IP: net.ParseIP(p.ip), Port: 48899}, nil
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func (f *fakePacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	for f.hang {
+		f.mu.Lock()
+		d := f.wdl
+		f.mu.Unlock()
+		if !d.IsZero() && time.Now().After(d) {
+			return 0, errors.New("i/o timeout")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	f.mu.Lock()
+	f.writes++
+	f.dst = addr
+	f.mu.Unlock()
+	for _, r := range f.replies {
+		f.ch <- r
+	}
+	return len(b), nil
+}
+
+func (f *fakePacketConn) Close() error {
+	f.mu.Lock()
+	f.closed = true
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *fakePacketConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}
+}
+
+func (f *fakePacketConn) SetDeadline(t time.Time) error {
+	return f.SetReadDeadline(t)
+}
+
+func (f *fakePacketConn) SetReadDeadline(t time.Time) error {
+	f.mu.Lock()
+	f.deadline = t
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *fakePacketConn) SetWriteDeadline(t time.Time) error {
+	f.mu.Lock()
+	f.wdl = t
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *fakePacketConn) written() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.writes
+}
+
+func (f *fakePacketConn) isClosed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
+
+// multicastResponder replies with each payload to the discovery packets.
+func multicastResponder(t *testing.T, payloads ...string) {
+	g, err := net.ResolveUDPAddr("udp4", "225.0.0.9:19000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.ListenMulticastUDP("udp4", nil, g)
+	if err != nil {
+		t.Skipf("multicast unavailable: %s", err)
+	}
+	t.Cleanup(func() {
+		l.Close()
+	})
+	go func() {
+		b := make([]byte, 64)
+		for {
+			_, src, err := l.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			for _, p := range payloads {
+				l.WriteToUDP([]byte(p), src)
+			}
+		}
+	}()
+}
@@ -0,0 +1,85 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package ffa3
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SetSpeedFactor sets the print speed as a percentage of the speeds in the
+// G-code, e.g. 50 to print at half speed. It can be changed during a print.
+//
+// percent is clamped between 10 and 300.
+func (d *Dev) SetSpeedFactor(percent int) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	resp, err := d.sendCommand(formatCmd("M220", fmt.Sprintf("S%d", clampPercent(percent))))
+	if resp != "" {
+		return fmt.Errorf("unknown reply: %q", resp)
+	}
+	return err
+}
+
+// SpeedFactor returns the print speed percentage.
+//
+// It returns ErrUnsupported if the firmware doesn't report it.
+func (d *Dev) SpeedFactor() (int, error) {
+	resp, err := d.sendQuery("M220")
+	if err != nil {
+		return 0, err
+	}
+	return parseFactor(resp, "FR:")
+}
+
+// SetFlowFactor sets the extrusion multiplier as a percentage, e.g. 105 to
+// extrude 5% more filament than in the G-code. It can be changed during a
+// print to tune under or over extrusion.
+//
+// percent is clamped between 10 and 300.
+func (d *Dev) SetFlowFactor(percent int) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	resp, err := d.sendCommand(formatCmd("M221", fmt.Sprintf("S%d", clampPercent(percent))))
+	if resp != "" {
+		return fmt.Errorf("unknown reply: %q", resp)
+	}
+	return err
+}
+
+// Internal
+
+const (
+	minFactor = 10
+	maxFactor = 300
+)
+
+// clampPercent clamps a speed or flow percentage to a sane range.
+func clampPercent(percent int) int {
+	if percent < minFactor {
+		return minFactor
+	}
+	if percent > maxFactor {
+		return maxFactor
+	}
+	return percent
+}
+
+// parseFactor parses a percentage reported as e.g. "FR:100%".
+func parseFactor(resp, prefix string) (int, error) {
+	for _, f := range strings.Fields(strings.Join(splitLines(resp), " ")) {
+		if strings.HasPrefix(f, prefix) {
+			v, err := strconv.Atoi(strings.TrimSuffix(f[len(prefix):], "%"))
+			if err != nil {
+				return 0, fmt.Errorf("unknown reply: %q", resp)
+			}
+			return v, nil
+		}
+	}
+	return 0, ErrUnsupported
+}
@@ -0,0 +1,72 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package ffa3
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSpeedFactor(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	if _, err := d.SpeedFactor(); err != ErrUnsupported {
+		t.Fatal(err)
+	}
+	f.set("M220", "FR:50%")
+	if v, err := d.SpeedFactor(); v != 50 || err != nil {
+		t.Fatal(v, err)
+	}
+	f.set("M220", "")
+	for _, v := range []int{50, 1, 1000} {
+		if err := d.SetSpeedFactor(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The percentage is clamped.
+	want := []string{"M220", "M220", "M220 S50", "M220 S10", "M220 S300"}
+	if got := f.received(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestSetFlowFactor(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	for _, v := range []int{105, 0, 500} {
+		if err := d.SetFlowFactor(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []string{"M221 S105", "M221 S10", "M221 S300"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+	f = newFakePrinter(t)
+	if err := f.connect(WithReadOnly()).SetFlowFactor(100); err != ErrReadOnly {
+		t.Fatal(err)
+	}
+}
+
+func TestParseFactor(t *testing.T) {
+	data := []struct {
+		in   string
+		want int
+		err  error
+	}{
+		{in: "FR:100%", want: 100},
+		{in: "echo: FR:75%", want: 75},
+		{in: "X:1", err: ErrUnsupported},
+	}
+	for i, line := range data {
+		if v, err := parseFactor(line.in, "FR:"); v != line.want || err != line.err {
+			t.Fatalf("#%d: got %d %v", i, v, err)
+		}
+	}
+	if _, err := parseFactor("FR:x%", "FR:"); err == nil || err == ErrUnsupported {
+		t.Fatal(err)
+	}
+}
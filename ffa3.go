@@ -6,37 +6,95 @@
 package ffa3
 
 import (
-	"bytes"
-	"encoding/binary"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"periph.io/x/conn/v3/physic"
 )
 
+// ErrUnsupported is returned when the printer doesn't support the requested
+// operation.
+var ErrUnsupported = errors.New("not supported by this printer")
+
+// ErrReadOnly is returned by the methods changing the printer state when
+// connected with WithReadOnly.
+var ErrReadOnly = errors.New("connected in read-only mode")
+
+// FirmwareError is returned when the printer acknowledged a command but
+// reported an error for it, via an "Error:" or "!!" line.
+type FirmwareError struct {
+	Cmd string
+	// Msg is the error line, e.g. "Error: Unknown command".
+	Msg string
+	// Body is the whole reply.
+	Body string
+}
+
+func (f *FirmwareError) Error() string {
+	return fmt.Sprintf("%s: firmware error: %s", f.Cmd, f.Msg)
+}
+
+// ErrClosed is returned by the methods called after Close.
+var ErrClosed = errors.New("connection closed")
+
+// ErrBusy is returned by Connect when another client, e.g. FlashPrint, already
+// has control of the printer. Disconnect the other client first or retry.
+var ErrBusy = errors.New("printer already has a connection; please disconnect other client first")
+
+// ErrResponseTooLarge is returned when a reply exceeds the limit set with
+// WithMaxResponseBytes. The connection is then out of sync, use Reconnect.
+var ErrResponseTooLarge = errors.New("reply too large")
+
 // Position is a position in millimeter.
 type Position struct {
 	X physic.Distance
 	Y physic.Distance
 	Z physic.Distance
-	A int
-	B int
+	// A and B are the extruders' filament positions. They are zero on single
+	// extruder printers.
+	A physic.Distance
+	B physic.Distance
 	_ struct{}
 }
 
 // Temperatures is the temperatures the printer can query or set.
+//
+// A zero value, i.e. 0K, means the printer didn't report it.
 type Temperatures struct {
 	Extruder physic.Temperature
 	Bed      physic.Temperature
 	Chamber  physic.Temperature
-	_        struct{}
+	// ExtruderTarget, BedTarget and ChamberTarget are the requested
+	// temperatures as reported by QueryTemp. 0°C means the heater is off.
+	ExtruderTarget physic.Temperature
+	BedTarget      physic.Temperature
+	ChamberTarget  physic.Temperature
+	_              struct{}
+}
+
+// ExtruderCelsius returns the extruder temperature in Celsius, for display.
+func (t Temperatures) ExtruderCelsius() float64 {
+	return t.Extruder.Celsius()
+}
+
+// BedCelsius returns the bed temperature in Celsius, for display.
+func (t Temperatures) BedCelsius() float64 {
+	return t.Bed.Celsius()
+}
+
+// ChamberCelsius returns the chamber temperature in Celsius, for display.
+func (t Temperatures) ChamberCelsius() float64 {
+	return t.Chamber.Celsius()
 }
 
 // Info is the printer information as reported by itself.
@@ -50,127 +108,347 @@ type Info struct {
 	Z             physic.Distance
 	ExtruderCount int
 	MacAddr       string
-	_             struct{}
+	// ToolOffsets is each tool's offset, when reported by the firmware.
+	ToolOffsets []Position
+	// MaxExtruderTemp and MaxBedTemp are the firmware's limits, zero when not
+	// reported.
+	MaxExtruderTemp physic.Temperature
+	MaxBedTemp      physic.Temperature
+	// NozzleDiameter and Material are the installed nozzle and the loaded
+	// filament, when reported by the firmware.
+	NozzleDiameter physic.Distance
+	Material       string
+	// FanCount is the number of fans, when reported by the firmware.
+	FanCount int
+	// QueueSize is the number of jobs the print queue can hold, zero when the
+	// firmware doesn't have one.
+	QueueSize int
+	_         struct{}
 }
 
 // Status is the printer status as reported by itself.
 type Status struct {
-	X        int
-	Y        int
-	Z        int
-	Status   string
-	MoveMode string
-	Stuff    string
+	// X, Y and Z are the raw endstop values.
+	X          int
+	Y          int
+	Z          int
+	XTriggered bool
+	YTriggered bool
+	ZTriggered bool
+	Status     string
+	MoveMode   string
+	Stuff      string
+	// HasDoorSensor is true when the firmware reports the door state in
+	// DoorOpen.
+	HasDoorSensor bool
+	DoorOpen      bool
+	_             struct{}
+}
+
+// MachineState is the MachineStatus reported in M119.
+type MachineState string
+
+// Known MachineState values.
+const (
+	MachineReady    MachineState = "READY"
+	MachineBusy     MachineState = "BUSY"
+	MachinePrinting MachineState = "BUILDING_FROM_SD"
+	MachinePaused   MachineState = "PAUSED"
+)
+
+// State returns the machine state.
+func (s Status) State() MachineState {
+	return MachineState(s.Status)
+}
+
+// AtHome returns true if all the endstops are triggered, which is the case
+// after homing.
+func (s Status) AtHome() bool {
+	return s.XTriggered && s.YTriggered && s.ZTriggered
+}
+
+// Job is the print job progress as reported by the printer.
+type Job struct {
+	// Printed and Total are the progress. The Adventurer 3 reports a
+	// percentage, so Total is 100.
+	Printed    int64
+	Total      int64
+	Layer      int64
+	LayerTotal int64
+	// Filename is the file being printed, empty when idle or not reported.
+	Filename string
 	_        struct{}
 }
 
-// Found is a printer found on the network.
-type Found struct {
-	IP   net.IP
-	Name string
-	_    struct{}
+// Capabilities is what the printer supports, as probed when connecting.
+type Capabilities struct {
+	HasHeatedBed      bool
+	HasChamber        bool
+	HasFilamentSensor bool
+	// HasQueue is true when the firmware reports a print queue in M115. The
+	// queue commands are not supported yet.
+	HasQueue      bool
+	ExtruderCount int
+	// FanCount is the number of fans as reported by M115, zero when not
+	// reported. Most firmware don't.
+	FanCount int
+	// Model is the detected printer model, e.g. "Adventurer 3", or empty when
+	// unknown.
+	Model string
+	// BuildX, BuildY and BuildZ is the build volume. It is the model's when
+	// detected, otherwise the one reported by M115.
+	BuildX physic.Distance
+	BuildY physic.Distance
+	BuildZ physic.Distance
+	// MaxExtruderTemp and MaxBedTemp are the highest targets accepted. They
+	// are the firmware's limits when reported, otherwise safe defaults.
+	MaxExtruderTemp physic.Temperature
+	MaxBedTemp      physic.Temperature
+	// commands is the set of supported command codes, see Supports.
+	commands map[string]bool
+	_        struct{}
 }
 
-func (f *Found) String() string {
-	return fmt.Sprintf("%s (%s)", f.Name, f.IP)
+// Dev represents a FlashForge Adventurer 3 printer on the network.
+//
+// To retrieve a MJPEG stream from the printer's camera, connect to
+// http://<ip>:8080/?action=stream.
+type Dev struct {
+	// mu serializes the commands sent over conn.
+	mu   sync.Mutex
+	conn io.ReadWriteCloser
+	caps Capabilities
+	// positioning is the G90/G91 mode last set.
+	positioning mode
+	// extrusion is the M82/M83 mode last set.
+	extrusion mode
+	// fanSpeed is the last speed set per fan, if fanSpeedKnown.
+	fanSpeed      [maxFans]uint8
+	fanSpeedKnown [maxFans]bool
+	// light is the last light color set, if lightKnown.
+	light      [3]uint8
+	lightKnown bool
+	// lightUpper is true if M146 expects uppercase channels.
+	lightUpper bool
+	// lastFile is the last file started with StartPrint, used by Reprint.
+	lastFile string
+	// ip and dialTimeout are used by Reconnect.
+	ip          string
+	dialTimeout time.Duration
+	// autoReconnect is set by WithAutoReconnect.
+	autoReconnect bool
+	// keepHeating is set by WithKeepHeatingOnCancel.
+	keepHeating bool
+	// readOnly is set by WithReadOnly.
+	readOnly bool
+	// unguardedRaw is set by WithUnguardedRaw.
+	unguardedRaw bool
+	// maxResponse is set by WithMaxResponseBytes.
+	maxResponse int
+
+	stateMu sync.Mutex
+	state   State
+	// closed is set by Close, guarded by mu.
+	closed bool
+	// writeTimeout is set by SetWriteTimeout, guarded by mu.
+	writeTimeout time.Duration
+	// lastResponse is the raw reply to the last command, guarded by mu.
+	lastResponse string
+	// writes is the number of successful writes, guarded by mu.
+	writes int64
+
+	// stats is keyed by command code.
+	statsMu sync.Mutex
+	stats   map[string]*CommandStats
+	// progressSample is used by TimeRemaining, guarded by statsMu.
+	progressSample progressSample
+
+	// tee is set by TeeTo.
+	teeMu sync.Mutex
+	tee   io.Writer
+
+	// Read pump state, only used with WithReadPump. pumpMu guards waiter;
+	// pushes is written with both mu and pumpMu held, see pushChan.
+	pumpMu   sync.Mutex
+	waiter   *waiter
+	pushes   chan string
+	pumpDone chan struct{}
+	pumpErr  error
 }
 
-// Search searches for printers via UDP discovery.
+// Option is an option to Connect.
+type Option func(o *options)
+
+// WithConnectRetry makes Connect try the control handshake up to attempts
+// times, waiting delay in between, while the printer returns ErrBusy.
 //
-// It does so by sending bytes to a predetermined multicast IP address.
-func Search(first bool, d time.Duration) ([]Found, error) {
-	// Magic multicast IP the FlashForge Adventurer 3 is listening to.
-	const ip = "225.0.0.9:19000"
-	raddr, err := net.ResolveUDPAddr("udp4", ip)
-	if err != nil {
-		return nil, fmt.Errorf("failed to resolve %s: %w", ip, err)
+// The previous client often releases control within a second or two.
+func WithConnectRetry(attempts int, delay time.Duration) Option {
+	return func(o *options) {
+		o.helloAttempts = attempts
+		o.helloDelay = delay
 	}
+}
 
-	// In practice we'd want to specify the right IP here, because otherwise
-	// laddr is set to 0.0.0.0. In practice it seems to work anyway.
-	// May want to revisit later.
-	l, err := net.ListenUDP("udp4", nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed listening to UDP: %w", err)
+// Connect connects to the printer.
+func Connect(ip string, opts ...Option) (*Dev, error) {
+	return ConnectContext(context.Background(), ip, opts...)
+}
+
+// WithReadOnly connects without taking control of the printer, so it can be
+// monitored while another client like FlashPrint is in control.
+//
+// Only the query methods can be used, the others return ErrReadOnly.
+func WithReadOnly() Option {
+	return func(o *options) {
+		o.readOnly = true
 	}
-	// Update the local address to get the port the listener is bound to.
-	laddr := l.LocalAddr().(*net.UDPAddr)
-	log.Printf("Listening on: %s", laddr)
-	b := [1024]byte{}
-	l.SetReadBuffer(len(b))
+}
 
-	// Read loop.
-	var out []Found
-	done := make(chan struct{})
-	go func() {
-		defer func() {
-			done <- struct{}{}
-		}()
-		for {
-			n, src, err := l.ReadFromUDP(b[:])
-			log.Printf("ReadFromUDP() = %v, %v, %v", n, src, err)
-			if err != nil {
-				// Ignore read errors since it'll fail when the connection is closed.
-				break
-			}
-			// TODO(maruel): It's a 140 bytes packet. Figure out the format.
-			if i := bytes.IndexByte(b[:n], 0); i != -1 {
-				out = append(out, Found{IP: src.IP, Name: string(b[:i])})
-			}
-			if first {
-				return
-			}
-		}
-	}()
+// WithUnguardedRaw lets SendRawCommand send commands without having taken
+// control of the printer, e.g. with WithReadOnly, to poke at undocumented
+// commands the firmware accepts anyway.
+//
+// The other methods stay guarded.
+func WithUnguardedRaw() Option {
+	return func(o *options) {
+		o.unguardedRaw = true
+	}
+}
 
-	// It seems that the content is ignored in practice, and that the printer
-	// replies to the UDP packet origin IP:port anyway.
-	magic := [8]byte{}
-	copy(magic[:4], laddr.IP)
-	binary.BigEndian.PutUint16(magic[4:], uint16(laddr.Port))
-	log.Printf("Magic: %x", magic)
-	if _, err := l.WriteTo(magic[:], raddr); err != nil {
-		l.Close()
-		<-done
-		return nil, fmt.Errorf("failed to write magic packet: %w", err)
+// WithMaxResponseBytes sets the maximum size of a reply before the command is
+// aborted with ErrResponseTooLarge, e.g. when the endpoint streams forever. It
+// defaults to defaultMaxResponse. 0 disables it.
+func WithMaxResponseBytes(n int) Option {
+	return func(o *options) {
+		o.maxResponse = n
 	}
+}
 
-	select {
-	case <-time.After(d):
-		err = l.Close()
-		<-done
-	case <-done:
-		err = l.Close()
+// WithDialTimeout sets the maximum time to establish the TCP connection. It
+// defaults to 3 seconds.
+func WithDialTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.dialTimeout = d
 	}
-	return out, err
 }
 
-// Dev represents a FlashForge Adventurer 3 printer on the network.
+// SetWriteTimeout sets the maximum time a write to the connection may block,
+// e.g. on a wedged socket. It defaults to defaultWriteTimeout. 0 disables it.
 //
-// To retrieve a MJPEG stream from the printer's camera, connect to
-// http://<ip>:8080/?action=stream.
-type Dev struct {
-	conn io.ReadWriteCloser
+// It is only effective on connections supporting deadlines, like net.Conn.
+func (d *Dev) SetWriteTimeout(t time.Duration) {
+	d.mu.Lock()
+	d.writeTimeout = t
+	d.mu.Unlock()
 }
 
-// Connect connects to the printer.
-func Connect(ip string) (*Dev, error) {
-	conn, err := net.Dial("tcp", ip+":8899")
+// ConnectContext connects to the printer, bounded by ctx.
+func ConnectContext(ctx context.Context, ip string, opts ...Option) (*Dev, error) {
+	o := newOptions(opts)
+	conn, err := dial(ctx, ip, o.dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	d, err := NewDev(ctx, conn, opts...)
+	if err != nil {
+		return nil, err
+	}
+	d.ip = ip
+	d.dialTimeout = o.dialTimeout
+	return d, nil
+}
+
+// TryConnect connects to the printer, failing fast when ip is not a
+// responsive printer.
+//
+// The dial and the handshake are bounded by tryConnectTimeout unless ctx has
+// an earlier deadline. It is meant to probe many candidate IPs.
+func TryConnect(ctx context.Context, ip string, opts ...Option) (*Dev, error) {
+	ctx, cancel := context.WithTimeout(ctx, tryConnectTimeout)
+	defer cancel()
+	return ConnectContext(ctx, ip, append([]Option{WithDialTimeout(tryConnectTimeout)}, opts...)...)
+}
+
+// NewDev takes control of the printer over an already established connection.
+//
+// conn is closed on failure.
+func NewDev(ctx context.Context, conn io.ReadWriteCloser, opts ...Option) (*Dev, error) {
+	o := newOptions(opts)
+	d := &Dev{conn: conn, keepHeating: o.keepHeating, readOnly: o.readOnly, autoReconnect: o.autoReconnect, unguardedRaw: o.unguardedRaw, maxResponse: o.maxResponse, state: StateConnecting, writeTimeout: defaultWriteTimeout}
+	if o.readPump {
+		d.startPump()
+	}
+	var err error
+	d.mu.Lock()
+	if !d.readOnly {
+		err = d.sendHello(ctx)
+	}
+	for i := 1; err == ErrBusy && i < o.helloAttempts; i++ {
+		log.Printf("Printer busy, retrying in %s", o.helloDelay)
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-time.After(o.helloDelay):
+			err = d.sendHello(ctx)
+		}
+	}
 	if err != nil {
+		// Control was not taken, so there is nothing to release.
+		d.closed = true
+		d.conn.Close()
+		d.setState(StateDisconnected)
+		d.mu.Unlock()
 		return nil, err
 	}
-	d := &Dev{conn: conn}
-	if err := d.sendHello(); err != nil {
-		d.Close()
+	d.mu.Unlock()
+	d.setState(StateConnected)
+	if err := d.probe(ctx); err != nil {
+		d.CloseContext(ctx)
 		return nil, err
 	}
 	return d, nil
 }
 
-// Close closes the connection.
+// Capabilities returns the printer capabilities as probed at connection.
+func (d *Dev) Capabilities() Capabilities {
+	return d.caps
+}
+
+// Conn returns the underlying connection.
+//
+// This is an escape hatch for experimentation. Using it concurrently with the
+// methods of Dev corrupts the command stream since it bypasses the command
+// serialization.
+func (d *Dev) Conn() io.ReadWriteCloser {
+	return d.conn
+}
+
+// Close releases control of the printer and closes the connection.
+//
+// Calling it again is a no-op. Afterward, the methods return ErrClosed. It
+// waits up to closeTimeout for the printer to acknowledge the release.
 func (d *Dev) Close() error {
-	err := d.sendBye()
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	return d.CloseContext(ctx)
+}
+
+// CloseContext is Close where ctx bounds the time waiting for the printer to
+// acknowledge the release of control. The connection is closed regardless.
+func (d *Dev) CloseContext(ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil
+	}
+	var err error
+	if !d.readOnly {
+		err = d.sendBye(ctx)
+	}
+	d.closed = true
 	err2 := d.conn.Close()
+	d.setState(StateDisconnected)
 	if err != nil {
 		return err
 	}
@@ -182,12 +460,20 @@ func (d *Dev) Close() error {
 // QueryPrinterInfo queries the printer information. This should never change so
 // it can be safely cached.
 func (d *Dev) QueryPrinterInfo(i *Info) error {
-	resp, err := d.sendCommand("M115")
+	return d.queryPrinterInfo(context.Background(), i)
+}
+
+// queryPrinterInfo is QueryPrinterInfo bounded by ctx.
+func (d *Dev) queryPrinterInfo(ctx context.Context, i *Info) error {
+	resp, err := d.sendQueryContext(ctx, "M115")
 	if err != nil {
 		return err
 	}
-	for _, line := range strings.Split(resp, "\n") {
-		line = strings.TrimRight(line, "\r")
+	i.ToolOffsets = nil
+	i.MaxExtruderTemp, i.MaxBedTemp = 0, 0
+	i.NozzleDiameter, i.Material = 0, ""
+	i.FanCount, i.QueueSize = 0, 0
+	for _, line := range splitLines(resp) {
 		switch {
 		case strings.HasPrefix(line, "Machine Type: "):
 			i.Type = line[len("Machine Type: "):]
@@ -207,21 +493,51 @@ func (d *Dev) QueryPrinterInfo(i *Info) error {
 			if err != nil {
 				return err
 			}
-			i.X = physic.MilliMetre * physic.Distance(v)
+			i.X = mmToDistance(float64(v))
 			if v, err = strconv.Atoi(m[2]); err != nil {
 				return err
 			}
-			i.Y = physic.MilliMetre * physic.Distance(v)
+			i.Y = mmToDistance(float64(v))
 			if v, err = strconv.Atoi(m[3]); err != nil {
 				return err
 			}
-			i.Z = physic.MilliMetre * physic.Distance(v)
+			i.Z = mmToDistance(float64(v))
 		case strings.HasPrefix(line, "Tool Count: "):
 			if i.ExtruderCount, err = strconv.Atoi(line[len("Tool Count: "):]); err != nil {
 				return err
 			}
 		case strings.HasPrefix(line, "Mac Address: "):
 			i.MacAddr = line[len("Mac Address: "):]
+		case strings.HasPrefix(line, "Tool ") && strings.Contains(line, " Offset: "):
+			if err := parseToolOffset(line, i); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "Max Extruder Temp: "):
+			if i.MaxExtruderTemp, err = parseTemperature(line[len("Max Extruder Temp: "):]); err != nil {
+				return fmt.Errorf("unknown reply: %q", line)
+			}
+		case strings.HasPrefix(line, "Max Bed Temp: "):
+			if i.MaxBedTemp, err = parseTemperature(line[len("Max Bed Temp: "):]); err != nil {
+				return fmt.Errorf("unknown reply: %q", line)
+			}
+		case strings.HasPrefix(line, "Nozzle Diameter: "):
+			if i.NozzleDiameter, err = parseDistance(strings.TrimSuffix(line[len("Nozzle Diameter: "):], "mm")); err != nil {
+				return fmt.Errorf("unknown reply: %q", line)
+			}
+		case strings.HasPrefix(line, "Material: "):
+			i.Material = line[len("Material: "):]
+		case strings.HasPrefix(line, "Fan Count: "):
+			if i.FanCount, err = strconv.Atoi(line[len("Fan Count: "):]); err != nil {
+				return fmt.Errorf("unknown reply: %q", line)
+			}
+		case strings.HasPrefix(line, "Queue Size: "):
+			if i.QueueSize, err = strconv.Atoi(line[len("Queue Size: "):]); err != nil {
+				return fmt.Errorf("unknown reply: %q", line)
+			}
+		case strings.HasPrefix(line, "Uptime: "):
+			// Changes over time, see Uptime.
+		case strings.HasPrefix(line, "IP Address: "), strings.HasPrefix(line, "Subnet Mask: "):
+			// See NetworkInfo.
 		case line == "":
 		default:
 			return fmt.Errorf("unknown reply: %q", line)
@@ -230,159 +546,1074 @@ func (d *Dev) QueryPrinterInfo(i *Info) error {
 	return nil
 }
 
-// QueryStatus returns the current printer status.
-func (d *Dev) QueryStatus(s *Status) error {
-	resp, err := d.sendCommand("M119")
+// Uptime returns the time since the printer booted.
+//
+// It returns ErrUnsupported if the firmware doesn't report it in M115.
+func (d *Dev) Uptime() (time.Duration, error) {
+	resp, err := d.sendQuery("M115")
 	if err != nil {
-		return err
+		return 0, err
 	}
-	// TODO(maruel): Implement.
-	for _, line := range strings.Split(resp, "\n") {
-		line = strings.TrimRight(line, "\r")
-		switch {
-		case line == "Endstop: X-max:0 Y-max:0 Z-max:0":
-		case strings.HasPrefix(line, "MachineStatus: "):
-			// PAUSED
-		case strings.HasPrefix(line, "MoveMode: "):
-			// PAUSED
-		case line == "Status: S:0 L:0 J:0 F:0":
-		default:
-			return fmt.Errorf("unknown reply: %q", line)
+	for _, line := range splitLines(resp) {
+		if strings.HasPrefix(line, "Uptime: ") {
+			return parseUptime(line[len("Uptime: "):])
 		}
 	}
-	return nil
+	return 0, ErrUnsupported
 }
 
-// QueryExtruderPosition returns the current extruder position.
-func (d *Dev) QueryExtruderPosition(p *Position) error {
-	resp, err := d.sendCommand("M114")
+// NetworkInfo returns the printer's network configuration.
+//
+// Only the fields the firmware reports in M115 are set. When the firmware
+// doesn't report its IP, the address of the connection is used.
+func (d *Dev) NetworkInfo() (ip net.IP, mask net.IPMask, mac string, err error) {
+	resp, err := d.sendQuery("M115")
 	if err != nil {
-		return err
+		return nil, nil, "", err
 	}
-	re := regexp.MustCompile(`^X:(\-?\d+(?:\.\d+)) Y:(\-?\d+(?:\.\d+)) Z:(\-?\d+(?:\.\d+)) A:(\d+) B:(\d+)$`)
-	m := re.FindStringSubmatch(resp)
-	if m == nil {
-		return fmt.Errorf("unknown reply: %q", resp)
+	for _, line := range splitLines(resp) {
+		switch {
+		case strings.HasPrefix(line, "Mac Address: "):
+			mac = line[len("Mac Address: "):]
+		case strings.HasPrefix(line, "IP Address: "):
+			if ip = net.ParseIP(line[len("IP Address: "):]); ip == nil {
+				return nil, nil, "", fmt.Errorf("unknown reply: %q", line)
+			}
+		case strings.HasPrefix(line, "Subnet Mask: "):
+			m := net.ParseIP(line[len("Subnet Mask: "):]).To4()
+			if m == nil {
+				return nil, nil, "", fmt.Errorf("unknown reply: %q", line)
+			}
+			mask = net.IPMask(m)
+		}
 	}
-	v, err := parseDistance(m[1])
+	if ip == nil {
+		if c, ok := d.conn.(net.Conn); ok {
+			ip = addrIP(c.RemoteAddr())
+		}
+	}
+	return ip, mask, mac, nil
+}
+
+// QueryStatus returns the current printer status.
+func (d *Dev) QueryStatus(s *Status) error {
+	resp, err := d.sendQuery("M119")
 	if err != nil {
 		return err
 	}
-	p.X = v
+	return parseStatus(resp, s)
+}
 
-	if v, err = parseDistance(m[2]); err != nil {
-		return err
+// IsPrinting returns true while a job is printing or paused.
+//
+// It is cheaper than QueryJobStatus since it only checks the machine state.
+func (d *Dev) IsPrinting() (bool, error) {
+	s := Status{}
+	if err := d.QueryStatus(&s); err != nil {
+		return false, err
 	}
-	p.Y = v
+	st := s.State()
+	return st == MachinePrinting || st == MachinePaused, nil
+}
 
-	if v, err = parseDistance(m[3]); err != nil {
-		return err
+// DoorOpen returns true if the enclosure's door is open.
+//
+// It returns ErrUnsupported if the firmware doesn't report a door sensor in
+// M119.
+func (d *Dev) DoorOpen() (bool, error) {
+	s := Status{}
+	if err := d.QueryStatus(&s); err != nil {
+		return false, err
 	}
-	p.Z = v
+	if !s.HasDoorSensor {
+		return false, ErrUnsupported
+	}
+	return s.DoorOpen, nil
+}
 
-	w, err := strconv.Atoi(m[4])
-	if err != nil {
-		return err
+// WaitForState polls the status every poll until the printer reaches the
+// machine state want.
+func (d *Dev) WaitForState(ctx context.Context, want MachineState, poll time.Duration) error {
+	for {
+		s := Status{}
+		if err := d.QueryStatus(&s); err != nil {
+			return err
+		}
+		if s.State() == want {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(poll):
+		}
 	}
-	p.A = w
-	if w, err = strconv.Atoi(m[5]); err != nil {
+}
+
+// QueryExtruderPosition returns the current extruder position.
+func (d *Dev) QueryExtruderPosition(p *Position) error {
+	resp, err := d.sendQuery("M114")
+	if err != nil {
 		return err
 	}
-	p.B = w
-	return nil
+	return parsePosition(resp, p)
 }
 
 // QueryTemp queries the temperatures.
 func (d *Dev) QueryTemp(t *Temperatures) error {
-	resp, err := d.sendCommand("M105")
+	resp, err := d.sendQuery("M105")
 	if err != nil {
 		return err
 	}
-	// TODO(maruel): Parse.
-	re := regexp.MustCompile(`^T(\d+):(\d+) /(\d+) B:(\d+)/(\d+)$`)
-	m := re.FindStringSubmatch(resp)
-	if m == nil {
-		return fmt.Errorf("unknown reply: %q", resp)
-	}
-	return nil
+	_, _, err = parseTemp(resp, t)
+	return err
 }
 
 // QueryJobStatus returns the current job status.
-func (d *Dev) QueryJobStatus() (string, error) {
-	// M27 S2 reports every 2 seconds.
-	resp, err := d.sendCommand("M27")
+func (d *Dev) QueryJobStatus(j *Job) error {
+	resp, err := d.sendQuery("M27")
 	if err != nil {
-		return "", err
+		return err
 	}
-	// "SD printing byte 0/100"
-	return resp, nil
+	return parseJob(resp, j)
+}
+
+// BedMesh returns the bed leveling grid as reported by M420 V, indexed by
+// row then column.
+//
+// It returns ErrUnsupported if the firmware doesn't report a mesh.
+func (d *Dev) BedMesh() ([][]physic.Distance, error) {
+	resp, err := d.sendQuery("M420 V")
+	if err != nil {
+		return nil, err
+	}
+	return parseMesh(resp)
+}
+
+// TimeRemaining estimates the remaining print time of the current job.
+//
+// The Adventurer 3 firmware only reports the progress in M27, not the time, so
+// it is estimated from the progress rate observed across calls. It returns
+// an error until two calls observed a progress change.
+func (d *Dev) TimeRemaining() (time.Duration, error) {
+	j := Job{}
+	if err := d.QueryJobStatus(&j); err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	d.statsMu.Lock()
+	defer d.statsMu.Unlock()
+	s := &d.progressSample
+	if j.Total == 0 || j.Printed < s.printed || s.total != j.Total {
+		// New or no job.
+		*s = progressSample{when: now, printed: j.Printed, total: j.Total}
+	}
+	if j.Total == 0 {
+		return 0, errors.New("no job is running")
+	}
+	if j.Printed == s.printed {
+		return 0, errors.New("not enough progress to estimate the remaining time; try again later")
+	}
+	rate := float64(j.Printed-s.printed) / float64(now.Sub(s.when))
+	return time.Duration(float64(j.Total-j.Printed) / rate), nil
+}
+
+// SubscribeJobStatus makes the printer report the job status every interval
+// on its own, instead of polling with QueryJobStatus.
+//
+// The reports are sent to the returned channel until ctx is done, then the
+// auto report is disabled and the channel is closed. Unless WithReadPump is
+// used, other commands block until then since the printer's reports would
+// interleave with their replies.
+//
+// Without WithReadPump, the command lock is held for the whole subscription,
+// so Close and CloseContext block until ctx is done too; cancel ctx before
+// closing.
+func (d *Dev) SubscribeJobStatus(ctx context.Context, every time.Duration) (<-chan Job, error) {
+	secs := int(every / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	d.mu.Lock()
+	resp, err := d.send(ctx, fmt.Sprintf("M27 S%d", secs))
+	if err != nil {
+		d.mu.Unlock()
+		return nil, err
+	}
+	out := make(chan Job, 1)
+	// The reply is the current status.
+	j := Job{}
+	if parseJob(resp, &j) == nil {
+		out <- j
+	}
+	pump := d.pushes != nil
+	if pump {
+		// The read pump routes the reports so other commands can proceed.
+		d.mu.Unlock()
+	}
+	go func() {
+		defer close(out)
+		err := d.readPushes(ctx, func(msg string) error {
+			// Each report is wrapped like the reply to M27.
+			if !strings.HasPrefix(msg, "CMD M27 ") {
+				return nil
+			}
+			body, err := unwrapReply("M27", msg)
+			j := Job{}
+			if err == nil {
+				err = parseJob(body, &j)
+			}
+			if err != nil {
+				log.Printf("SubscribeJobStatus: %s", err)
+				return nil
+			}
+			select {
+			case out <- j:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		log.Printf("SubscribeJobStatus: %s", err)
+		if pump {
+			d.mu.Lock()
+		}
+		defer d.mu.Unlock()
+		// Disable the auto report. Use a new context since ctx is done.
+		ctx2, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := d.send(ctx2, "M27 S0"); err != nil {
+			log.Printf("SubscribeJobStatus: failed to disable auto report: %s", err)
+		}
+	}()
+	return out, nil
 }
 
 // Commands
 
 // SetLight turns the printer's light on or off.
 func (d *Dev) SetLight(on bool) error {
-	// Channels must be lowercase. Duh.
-	cmd := "M146 r0 g0 b0 F0"
+	var v uint8
 	if on {
-		cmd = "M146 r255 g255 b255 F0"
+		v = 255
+	}
+	return d.SetLightColor(v, v, v)
+}
+
+// SetLightColor sets the printer's light color.
+func (d *Dev) SetLightColor(r, g, b uint8) error {
+	return d.SetLightColorFade(r, g, b, 0)
+}
+
+// SetLightColorFade sets the printer's light color, transitioning over fade.
+//
+// fade is rounded to the firmware's resolution of 100ms.
+func (d *Dev) SetLightColorFade(r, g, b uint8, fade time.Duration) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	f, err := fadeUnits(fade)
+	if err != nil {
+		return err
 	}
-	resp, err := d.sendCommand(cmd)
+	// Channels must be lowercase on older firmware. Duh.
+	cmd := formatCmd("M146", fmt.Sprintf("r%d", r), fmt.Sprintf("g%d", g), fmt.Sprintf("b%d", b), fmt.Sprintf("F%d", f))
+	if d.lightUpper {
+		cmd = formatCmd("M146", fmt.Sprintf("R%d", r), fmt.Sprintf("G%d", g), fmt.Sprintf("B%d", b), fmt.Sprintf("F%d", f))
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	resp, err := d.send(context.Background(), cmd)
 	if resp != "" {
 		return fmt.Errorf("unknown reply: %q", resp)
 	}
+	if err == nil {
+		d.light = [3]uint8{r, g, b}
+		d.lightKnown = true
+	}
 	return err
 }
 
-// SetFan turns the printer's fan on or off.
+// LightColor returns the light color last set via SetLight or SetLightColor.
+//
+// M119 only reports whether the light is on so it is the cached value. It
+// returns an error if it was not set since connecting.
+func (d *Dev) LightColor() (r, g, b uint8, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.lightKnown {
+		return 0, 0, 0, errors.New("light color unknown; it wasn't set since connecting")
+	}
+	return d.light[0], d.light[1], d.light[2], nil
+}
+
+// SetFan turns the printer's main fan, index 0, on or off.
 func (d *Dev) SetFan(on bool) error {
+	var speed uint8
+	if on {
+		speed = 255
+	}
+	return d.SetFanSpeed(0, speed)
+}
+
+// SetFanSpeed sets the speed of the fan index, 0 being off.
+//
+// index 0 is the main fan. Others, e.g. an auxiliary fan, depend on the model.
+// index is validated against Capabilities.FanCount when the firmware reports
+// it.
+func (d *Dev) SetFanSpeed(index int, speed uint8) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	if err := d.checkFan(index); err != nil {
+		return err
+	}
 	// TODO(maruel): It turns back on right after!
 	// TODO(maruel): Doesn't work.
-	cmd := "M107 P0"
-	if on {
-		cmd = "M106 P0 S255"
+	cmd := formatCmd("M107", fmt.Sprintf("P%d", index))
+	if speed != 0 {
+		cmd = formatCmd("M106", fmt.Sprintf("P%d", index), fmt.Sprintf("S%d", speed))
 	}
-	resp, err := d.sendCommand(cmd)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	resp, err := d.send(context.Background(), cmd)
 	if resp != "" {
 		return fmt.Errorf("unknown reply: %q", resp)
 	}
+	if err == nil {
+		d.fanSpeed[index] = speed
+		d.fanSpeedKnown[index] = true
+	}
 	return err
 }
 
-// StopJob stops the running job.
-func (d *Dev) StopJob() error {
-	resp, err := d.sendCommand("M26")
-	if resp != "" {
-		return fmt.Errorf("unknown reply: %q", resp)
+// FanSpeed returns the speed of the fan index last set via SetFan or
+// SetFanSpeed.
+//
+// The firmware doesn't report the fan speed so it is the cached value. It
+// returns an error if it was not set since connecting.
+func (d *Dev) FanSpeed(index int) (uint8, error) {
+	if err := d.checkFan(index); err != nil {
+		return 0, err
 	}
-	return err
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.fanSpeedKnown[index] {
+		return 0, errors.New("fan speed unknown; it wasn't set since connecting")
+	}
+	return d.fanSpeed[index], nil
 }
 
-// SendRawCommand sends a raw command, returns the trimmed response.
-func (d *Dev) SendRawCommand(cmd string) (string, error) {
-	return d.sendCommand(cmd)
+// NotifyOption is an option to Notify.
+type NotifyOption func(o *notifyOptions)
+
+// WithNotifyTone sets the beep frequency in Hz. It defaults to 1000Hz.
+func WithNotifyTone(hz int) NotifyOption {
+	return func(o *notifyOptions) {
+		o.hz = hz
+	}
 }
 
-// Internal
+// WithNotifyDuration sets the beep duration. It defaults to 500ms.
+func WithNotifyDuration(d time.Duration) NotifyOption {
+	return func(o *notifyOptions) {
+		o.duration = d
+	}
+}
 
-// sendHello sends an hello command that must be the first command sent.
-func (d *Dev) sendHello() error {
-	resp, err := d.sendCommand("M601 S1")
-	if err != nil {
+// Notify beeps to get the user's attention, e.g. when a print is done.
+//
+// It returns ErrUnsupported if the firmware rejects M300.
+func (d *Dev) Notify(opts ...NotifyOption) error {
+	if err := d.checkWritable(); err != nil {
 		return err
 	}
-	if resp == "Control failed." {
-		return errors.New("printer already has a connection; please disconnect other client first")
+	o := notifyOptions{hz: notifyTone, duration: notifyDuration}
+	for _, opt := range opts {
+		opt(&o)
 	}
-	if resp != "Control Success." {
-		return fmt.Errorf("failed to take control: %q", resp)
+	if o.hz <= 0 || o.duration <= 0 {
+		return fmt.Errorf("invalid beep %dHz for %s", o.hz, o.duration)
 	}
-	return nil
-}
-
-// sendBye sends a bye command that must be the last command sent.
-func (d *Dev) sendBye() error {
-	resp, err := d.sendCommand("M602")
+	resp, err := d.sendCommand(formatCmd("M300", fmt.Sprintf("S%d", o.hz), fmt.Sprintf("P%d", o.duration/time.Millisecond)))
+	var ferr *FirmwareError
+	if errors.As(err, &ferr) {
+		return ErrUnsupported
+	}
+	if resp != "" {
+		return fmt.Errorf("unknown reply: %q", resp)
+	}
+	return err
+}
+
+// SetChamberTemperature sets the enclosure heater target temperature.
+//
+// Only printers reporting a chamber reading via M105 support it, otherwise
+// ErrUnsupported is returned.
+func (d *Dev) SetChamberTemperature(t physic.Temperature) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	if !d.caps.Supports("M141") {
+		return ErrUnsupported
+	}
+	resp, err := d.sendCommand(formatCmd("M141", fmt.Sprintf("S%d", toCelsius(t))))
+	if resp != "" {
+		return fmt.Errorf("unknown reply: %q", resp)
+	}
+	return err
+}
+
+// SetName renames the printer, as shown in Info.Name and in discovery.
+//
+// The name is limited to printable ASCII since the firmware can't handle
+// anything else.
+func (d *Dev) SetName(name string) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	if name == "" || len(name) > 32 {
+		return fmt.Errorf("invalid name %q: must be between 1 and 32 characters", name)
+	}
+	for _, c := range name {
+		// "~" starts a command.
+		if c < 0x20 || c > 0x7E || c == '~' {
+			return fmt.Errorf("invalid name %q: unsupported character %q", name, c)
+		}
+	}
+	resp, err := d.sendCommand("M610 " + name)
+	if err != nil {
+		return err
+	}
+	if resp != "" {
+		return fmt.Errorf("unknown reply: %q", resp)
+	}
+	i := Info{}
+	if err := d.QueryPrinterInfo(&i); err != nil {
+		return err
+	}
+	if i.Name != name {
+		return fmt.Errorf("failed to rename printer: name is still %q", i.Name)
+	}
+	return nil
+}
+
+// FullStop does an emergency stop (M112), halting the printer right away.
+//
+// The firmware may halt without acknowledging it, so once M112 is written, no
+// reply within fullStopTimeout or the connection being closed is considered a
+// success.
+func (d *Dev) FullStop() error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), fullStopTimeout)
+	defer cancel()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	writes := d.writes
+	_, err := d.sendRaw(ctx, "M112")
+	var nerr net.Error
+	timeout := err == context.DeadlineExceeded || (errors.As(err, &nerr) && nerr.Timeout())
+	if err != nil && d.writes != writes && (timeout || errors.Is(err, io.EOF)) {
+		log.Printf("FullStop: no acknowledgement: %s", err)
+		return nil
+	}
+	return err
+}
+
+// PauseJob pauses the running job.
+func (d *Dev) PauseJob() error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	resp, err := d.sendCommand("M25")
+	if resp != "" {
+		return fmt.Errorf("unknown reply: %q", resp)
+	}
+	return err
+}
+
+// ResumeJob resumes the job paused with PauseJob.
+func (d *Dev) ResumeJob() error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	resp, err := d.sendCommand("M24")
+	if resp != "" {
+		return fmt.Errorf("unknown reply: %q", resp)
+	}
+	return err
+}
+
+// PauseAtHeight polls the extruder position every poll during a print and
+// pauses the job once the nozzle rises to z, e.g. to swap filament or insert
+// a part.
+//
+// The nozzle must first be seen below z while printing, so a position left
+// high by the previous job or homing doesn't pause right away. It returns an
+// error if the job ends before reaching z.
+func (d *Dev) PauseAtHeight(ctx context.Context, z physic.Distance, poll time.Duration) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	armed := false
+	for {
+		p := Position{}
+		if err := d.QueryExtruderPosition(&p); err != nil {
+			return err
+		}
+		if armed && p.Z >= z {
+			return d.PauseJob()
+		}
+		s := Status{}
+		if err := d.QueryStatus(&s); err != nil {
+			return err
+		}
+		switch s.State() {
+		case MachineReady:
+			return fmt.Errorf("job ended at %s before reaching %s", p.Z, z)
+		case MachinePrinting:
+			if p.Z < z {
+				armed = true
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(poll):
+		}
+	}
+}
+
+// ConfirmReset must be passed to FactoryReset to confirm the intent.
+type ConfirmReset struct{}
+
+// FactoryReset restores the firmware settings to their factory defaults
+// (M502).
+//
+// confirm must be non-nil, so it can't be called by accident. The printer may
+// reboot, in which case the connection is lost and the Dev must be closed.
+func (d *Dev) FactoryReset(confirm *ConfirmReset) error {
+	if confirm == nil {
+		return errors.New("refusing to reset to factory defaults without confirmation")
+	}
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	resp, err := d.sendCommand("M502")
+	if resp != "" {
+		return fmt.Errorf("unknown reply: %q", resp)
+	}
+	return err
+}
+
+// StopJob stops the running job.
+func (d *Dev) StopJob() error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	resp, err := d.sendCommand("M26")
+	if resp != "" {
+		return fmt.Errorf("unknown reply: %q", resp)
+	}
+	return err
+}
+
+// AutoHome homes all axes and returns the resulting position.
+//
+// Homing is slow so use ctx to bound the time to wait for it. The printer
+// only sends the final "ok" once homing is done.
+func (d *Dev) AutoHome(ctx context.Context) (Position, error) {
+	if err := d.checkWritable(); err != nil {
+		return Position{}, err
+	}
+	p := Position{}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	resp, err := d.send(ctx, "G28")
+	if err != nil {
+		return p, err
+	}
+	if resp != "" {
+		return p, fmt.Errorf("unknown reply: %q", resp)
+	}
+	if resp, err = d.send(ctx, "M114"); err != nil {
+		return p, err
+	}
+	err = parsePosition(resp, &p)
+	return p, err
+}
+
+// SafeShutdownOption is an option to SafeShutdown.
+type SafeShutdownOption func(o *shutdownOptions)
+
+// WithShutdownHome makes SafeShutdown home the axes once the heaters are off.
+func WithShutdownHome() SafeShutdownOption {
+	return func(o *shutdownOptions) {
+		o.home = true
+	}
+}
+
+// SafeShutdown is an end of day routine: it stops the running job, turns the
+// heaters off, homes the axes with WithShutdownHome, turns the fan and the
+// light off, then releases control and closes the connection.
+//
+// Each step is best effort; the errors are collected and returned together.
+// The steps left when ctx is done are skipped, except closing the connection.
+func (d *Dev) SafeShutdown(ctx context.Context, opts ...SafeShutdownOption) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	o := shutdownOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	steps := []struct {
+		name string
+		f    func() error
+	}{
+		{"stop job", d.StopJob},
+		{"turn extruder off", func() error { return d.SetExtruderTemperature(physic.ZeroCelsius) }},
+		{"turn bed off", func() error {
+			if !d.caps.HasHeatedBed {
+				return nil
+			}
+			return d.SetBedTemperature(physic.ZeroCelsius)
+		}},
+		{"turn chamber off", func() error {
+			if !d.caps.HasChamber {
+				return nil
+			}
+			return d.SetChamberTemperature(physic.ZeroCelsius)
+		}},
+		{"home", func() error {
+			if !o.home {
+				return nil
+			}
+			_, err := d.AutoHome(ctx)
+			return err
+		}},
+		{"turn fan off", func() error { return d.SetFan(false) }},
+		{"turn light off", func() error { return d.SetLight(false) }},
+	}
+	var errs []string
+	for _, s := range steps {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", s.name, err))
+			break
+		}
+		if err := s.f(); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", s.name, err))
+		}
+	}
+	if err := d.Close(); err != nil {
+		errs = append(errs, fmt.Sprintf("close: %s", err))
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("safe shutdown: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// SetPositioningMode selects absolute (G90) or relative (G91) positioning for
+// the following moves, e.g. G1 sent via SendRawCommand.
+//
+// The mode is tracked so the command is only sent when it changes.
+func (d *Dev) SetPositioningMode(absolute bool) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.setPositioningMode(context.Background(), absolute)
+}
+
+// SetExtrusionMode selects absolute (M82) or relative (M83) extrusion for the
+// following moves.
+//
+// The mode is tracked so the command is only sent when it changes. G90 and G91
+// change it too.
+func (d *Dev) SetExtrusionMode(relative bool) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.setExtrusionMode(context.Background(), relative)
+}
+
+// ExtrusionMode returns true if the extrusion mode is relative.
+//
+// It returns an error if the mode wasn't set since connecting.
+func (d *Dev) ExtrusionMode() (relative bool, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.extrusion == modeUnknown {
+		return false, errors.New("extrusion mode unknown; it wasn't set since connecting")
+	}
+	return d.extrusion == modeRelative, nil
+}
+
+// Extrude pushes length of filament at speed, or retracts it when negative.
+//
+// It switches to relative extrusion for the move and restores the previous
+// mode afterward, if it was known.
+func (d *Dev) Extrude(length physic.Distance, speed physic.Speed) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ctx := context.Background()
+	prev := d.extrusion
+	if err := d.setExtrusionMode(ctx, true); err != nil {
+		return err
+	}
+	resp, err := d.send(ctx, formatCmd("G1", "E"+formatMM(length), fmt.Sprintf("F%d", speedToMMPerMin(speed))))
+	if resp != "" && err == nil {
+		err = fmt.Errorf("unknown reply: %q", resp)
+	}
+	if prev == modeAbsolute {
+		if err2 := d.setExtrusionMode(ctx, false); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// MoveTo moves the extruder to the absolute position at speed.
+//
+// The position is validated against the build volume when known.
+func (d *Dev) MoveTo(x, y, z physic.Distance, speed physic.Speed) error {
+	if err := d.checkVolume(x, y, z); err != nil {
+		return err
+	}
+	return d.move(true, x, y, z, speed)
+}
+
+// MoveBy moves the extruder relative to its current position at speed.
+func (d *Dev) MoveBy(x, y, z physic.Distance, speed physic.Speed) error {
+	return d.move(false, x, y, z, speed)
+}
+
+// SendRawCommand sends a raw command, returns the trimmed response.
+//
+// It returns ErrReadOnly with WithReadOnly, unless WithUnguardedRaw is used.
+func (d *Dev) SendRawCommand(cmd string) (string, error) {
+	if !d.unguardedRaw {
+		if err := d.checkWritable(); err != nil {
+			return "", err
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	resp, err := d.send(context.Background(), cmd)
+	if err == nil {
+		d.trackMode(cmd)
+	}
+	return resp, err
+}
+
+// TeeTo mirrors all the bytes read from and written to the printer to w, e.g.
+// a file, to capture the exact wire protocol. Use nil to stop.
+//
+// The writes to w are serialized.
+func (d *Dev) TeeTo(w io.Writer) {
+	d.teeMu.Lock()
+	d.tee = w
+	d.teeMu.Unlock()
+}
+
+// LastResponse returns the untrimmed reply to the last command, including the
+// "CMD X Received." wrapping, e.g. to report the exact bytes a parser failed
+// on.
+func (d *Dev) LastResponse() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.lastResponse
+}
+
+// Internal
+
+// trackMode keeps the tracked state in sync with a raw command that succeeded.
+//
+// d.mu must be held.
+func (d *Dev) trackMode(cmd string) {
+	switch commandCode(cmd) {
+	case "G90":
+		d.positioning = modeAbsolute
+		d.extrusion = modeAbsolute
+	case "G91":
+		d.positioning = modeRelative
+		d.extrusion = modeRelative
+	case "M82":
+		d.extrusion = modeAbsolute
+	case "M83":
+		d.extrusion = modeRelative
+	}
+}
+
+// sendHello sends an hello command that must be the first command sent.
+//
+// Right after the printer powers on, the first reply may be garbage left in a
+// stale buffer, so the pending bytes are drained and the handshake is retried
+// once. d.mu must be held.
+func (d *Dev) sendHello(ctx context.Context) error {
+	err := d.hello(ctx)
+	if err == nil || err == ErrBusy || ctx.Err() != nil || isConnReset(err) {
+		return err
+	}
+	log.Printf("sendHello: %s; retrying", err)
+	d.drain()
+	return d.hello(ctx)
+}
+
+// hello sends the hello command once.
+//
+// d.mu must be held.
+func (d *Dev) hello(ctx context.Context) error {
+	resp, err := d.send(ctx, "M601 S1")
+	if err != nil {
+		return fmt.Errorf("handshake failed: %w", err)
+	}
+	if resp == "Control failed." {
+		d.setState(StateBusy)
+		return ErrBusy
+	}
+	if resp != "Control Success." {
+		return fmt.Errorf("failed to take control: %q", resp)
+	}
+	return nil
+}
+
+// write writes b to the connection, bounded by the write timeout.
+//
+// d.mu must be held.
+func (d *Dev) write(ctx context.Context, b []byte) error {
+	if w, ok := d.conn.(writeDeadliner); ok && d.writeTimeout > 0 {
+		t := time.Now().Add(d.writeTimeout)
+		if dl, ok := ctx.Deadline(); ok && dl.Before(t) {
+			t = dl
+		}
+		w.SetWriteDeadline(t)
+		// ctx may have been canceled before the deadline was overridden.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+	// Mirrored first so the tee keeps the order on synchronous connections.
+	d.teeBytes(b)
+	_, err := d.conn.Write(b)
+	if err == nil {
+		d.writes++
+	}
+	var nerr net.Error
+	if err != nil && ctx.Err() == nil && errors.As(err, &nerr) && nerr.Timeout() {
+		return fmt.Errorf("write timed out after %s: %w", d.writeTimeout, err)
+	}
+	return err
+}
+
+// read reads from conn, mirroring the bytes to the tee.
+func (d *Dev) read(conn io.Reader, b []byte) (int, error) {
+	n, err := conn.Read(b)
+	d.teeBytes(b[:n])
+	return n, err
+}
+
+// teeBytes mirrors b to the writer set by TeeTo, if any.
+func (d *Dev) teeBytes(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	d.teeMu.Lock()
+	defer d.teeMu.Unlock()
+	if d.tee != nil {
+		if _, err := d.tee.Write(b); err != nil {
+			log.Printf("tee: %s", err)
+		}
+	}
+}
+
+// drain discards the bytes pending on the connection.
+//
+// It is a no-op with the read pump, which routes them to Pushes, or when the
+// connection doesn't support deadlines. d.mu must be held.
+func (d *Dev) drain() {
+	c, ok := d.conn.(deadliner)
+	if !ok || d.pushes != nil {
+		return
+	}
+	defer c.SetDeadline(time.Time{})
+	b := [4096]byte{}
+	for {
+		c.SetDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := d.read(d.conn, b[:])
+		if n != 0 {
+			log.Printf("drain: %q", b[:n])
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// checkWritable returns ErrReadOnly if the printer state must not be changed.
+func (d *Dev) checkWritable() error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// setPositioningMode sends G90 or G91 if the mode differs from the tracked
+// one.
+//
+// d.mu must be held.
+func (d *Dev) setPositioningMode(ctx context.Context, absolute bool) error {
+	m, cmd := modeRelative, "G91"
+	if absolute {
+		m, cmd = modeAbsolute, "G90"
+	}
+	if d.positioning == m {
+		return nil
+	}
+	resp, err := d.send(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	if resp != "" {
+		return fmt.Errorf("unknown reply: %q", resp)
+	}
+	d.positioning = m
+	// G90 and G91 also apply to the extruder.
+	d.extrusion = m
+	return nil
+}
+
+// setExtrusionMode sends M82 or M83 if the extrusion mode changes.
+//
+// d.mu must be held.
+func (d *Dev) setExtrusionMode(ctx context.Context, relative bool) error {
+	m, cmd := modeAbsolute, "M82"
+	if relative {
+		m, cmd = modeRelative, "M83"
+	}
+	if d.extrusion == m {
+		return nil
+	}
+	resp, err := d.send(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	if resp != "" {
+		return fmt.Errorf("unknown reply: %q", resp)
+	}
+	d.extrusion = m
+	return nil
+}
+
+// move sends a G1 in the requested positioning mode.
+func (d *Dev) move(absolute bool, x, y, z physic.Distance, speed physic.Speed) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	cmd := formatCmd("G1", "X"+formatMM(x), "Y"+formatMM(y), "Z"+formatMM(z), fmt.Sprintf("F%d", speedToMMPerMin(speed)))
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ctx := context.Background()
+	if err := d.setPositioningMode(ctx, absolute); err != nil {
+		return err
+	}
+	resp, err := d.send(ctx, cmd)
+	if resp != "" {
+		return fmt.Errorf("unknown reply: %q", resp)
+	}
+	return err
+}
+
+// checkFan returns an error if index is not a valid fan.
+func (d *Dev) checkFan(index int) error {
+	n := maxFans
+	if d.caps.FanCount > 0 && d.caps.FanCount < n {
+		n = d.caps.FanCount
+	}
+	if index < 0 || index >= n {
+		return fmt.Errorf("invalid fan %d: must be between 0 and %d", index, n-1)
+	}
+	return nil
+}
+
+// checkVolume returns an error if the absolute position is outside the build
+// volume.
+//
+// The origin may be at the bed center, so only the magnitude is checked.
+func (d *Dev) checkVolume(x, y, z physic.Distance) error {
+	for _, a := range []struct {
+		name string
+		v    physic.Distance
+		max  physic.Distance
+	}{{"X", x, d.caps.BuildX}, {"Y", y, d.caps.BuildY}, {"Z", z, d.caps.BuildZ}} {
+		if a.max == 0 {
+			continue
+		}
+		if a.v > a.max || a.v < -a.max {
+			return fmt.Errorf("invalid %s position %s: outside the build volume of %s", a.name, a.v, a.max)
+		}
+	}
+	return nil
+}
+
+// probe queries the printer to populate d.caps, bounded by ctx.
+func (d *Dev) probe(ctx context.Context) error {
+	i := Info{}
+	if err := d.queryPrinterInfo(ctx, &i); err != nil {
+		return err
+	}
+	d.caps.ExtruderCount = i.ExtruderCount
+	d.caps.HasQueue = i.QueueSize > 0
+	d.caps.FanCount = i.FanCount
+	detectModel(&i, &d.caps)
+	if d.caps.MaxExtruderTemp = i.MaxExtruderTemp; d.caps.MaxExtruderTemp == 0 {
+		d.caps.MaxExtruderTemp = maxExtruderTemp
+	}
+	if d.caps.MaxBedTemp = i.MaxBedTemp; d.caps.MaxBedTemp == 0 {
+		d.caps.MaxBedTemp = maxBedTemp
+	}
+	d.lightUpper = lightUppercase(i.Firmware)
+
+	resp, err := d.sendCommandContext(ctx, "M105")
+	if err != nil {
+		return err
+	}
+	t := Temperatures{}
+	if d.caps.HasHeatedBed, d.caps.HasChamber, err = parseTemp(resp, &t); err != nil {
+		return err
+	}
+
+	if resp, err = d.sendCommandContext(ctx, "M119"); err != nil {
+		return err
+	}
+	// The F field of "Status: S:0 L:0 J:0 F:0" is the filament sensor.
+	for _, line := range splitLines(resp) {
+		if strings.HasPrefix(line, "Status: ") {
+			for _, f := range strings.Fields(line) {
+				if strings.HasPrefix(f, "F:") {
+					d.caps.HasFilamentSensor = true
+				}
+			}
+		}
+	}
+	detectCommands(&d.caps)
+	return nil
+}
+
+// sendBye sends a bye command that must be the last command sent.
+//
+// d.mu must be held.
+func (d *Dev) sendBye(ctx context.Context) error {
+	resp, err := d.send(ctx, "M602")
 	if err != nil {
 		return err
 	}
@@ -394,9 +1625,141 @@ func (d *Dev) sendBye() error {
 
 // sendCommand sends a command, returns the trimmed response.
 func (d *Dev) sendCommand(cmd string) (string, error) {
+	return d.sendCommandContext(context.Background(), cmd)
+}
+
+// sendCommandContext is sendCommand bounded by ctx.
+func (d *Dev) sendCommandContext(ctx context.Context, cmd string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.send(ctx, cmd)
+}
+
+// send sends a command, returns the trimmed response.
+//
+// d.mu must be held.
+func (d *Dev) send(ctx context.Context, cmd string) (string, error) {
+	var resp string
+	start := time.Now()
+	err := d.withContext(ctx, func() error {
+		var err error
+		resp, err = d.roundTrip(ctx, cmd)
+		return err
+	})
+	d.record(cmd, time.Since(start), err)
+	d.trackState(err)
+	return resp, err
+}
+
+// withContext runs f, which does I/O on d.conn, bounded by ctx.
+//
+// ctx is enforced via the connection deadline when the connection supports
+// it. With the read pump, only the write deadline is used since the pump does
+// the reads. d.mu must be held.
+func (d *Dev) withContext(ctx context.Context, f func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var c deadliner
+	if w, ok := d.conn.(writeDeadliner); ok && d.pushes != nil {
+		c = writeDeadline{w}
+	} else if dl, ok := d.conn.(deadliner); ok {
+		c = dl
+	}
+	if c != nil && ctx.Done() != nil {
+		if t, ok := ctx.Deadline(); ok {
+			c.SetDeadline(t)
+		}
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			select {
+			case <-ctx.Done():
+				// Unblock the pending I/O right away.
+				c.SetDeadline(time.Unix(1, 0))
+			case <-stop:
+			}
+		}()
+		defer func() {
+			close(stop)
+			<-done
+			c.SetDeadline(time.Time{})
+		}()
+	}
+	err := f()
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// sendCommandRaw sends a command, returns the untrimmed response.
+//
+// Contrary to sendCommand, the response is not expected to be wrapped in
+// "CMD X Received.\r\n" ... "ok\r\n". It is only used for M112 since the
+// firmware halts right away, possibly without acknowledging it.
+func (d *Dev) sendCommandRaw(cmd string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.sendRaw(context.Background(), cmd)
+}
+
+// sendRaw is the sendCommandRaw version that requires d.mu to be held.
+func (d *Dev) sendRaw(ctx context.Context, cmd string) (string, error) {
+	var resp string
+	start := time.Now()
+	err := d.withContext(ctx, func() error {
+		var err error
+		resp, err = d.roundTripRaw(ctx, cmd, true)
+		return err
+	})
+	d.record(cmd, time.Since(start), err)
+	d.trackState(err)
+	return resp, err
+}
+
+// roundTrip sends a command, returns the trimmed response.
+//
+// d.mu must be held.
+func (d *Dev) roundTrip(ctx context.Context, cmd string) (string, error) {
+	resp, err := d.roundTripRaw(ctx, cmd, false)
+	if err != nil {
+		return resp, err
+	}
+	line, err := unwrapReply(commandCode(cmd), resp)
+	if err != nil {
+		return resp, err
+	}
+	log.Printf("sendCommand(%q): %q", cmd, line)
+	if err := firmwareError(cmd, line); err != nil {
+		return "", err
+	}
+	return line, nil
+}
+
+// roundTripRaw sends a command, returns the untrimmed response.
+//
+// raw is true when the reply may not be wrapped. d.mu must be held.
+func (d *Dev) roundTripRaw(ctx context.Context, cmd string, raw bool) (string, error) {
+	if d.closed {
+		return "", ErrClosed
+	}
+	resp, err := d.readReply(ctx, cmd, raw)
+	d.lastResponse = resp
+	return resp, err
+}
+
+// readReply sends cmd and reads its reply.
+//
+// d.mu must be held.
+func (d *Dev) readReply(ctx context.Context, cmd string, raw bool) (string, error) {
+	if d.pushes != nil {
+		return d.pumpRoundTrip(ctx, cmd, raw)
+	}
 	// "~" is required, "\r\n" is not, "\n" is sufficient.
 	//log.Printf("sendCommand(%q)", cmd)
-	if _, err := d.conn.Write([]byte("~" + cmd + "\n")); err != nil {
+	if err := d.write(ctx, []byte("~"+cmd+"\n")); err != nil {
 		log.Printf("sendCommand(%q): %s", cmd, err)
 		return "", err
 	}
@@ -404,35 +1767,294 @@ func (d *Dev) sendCommand(cmd string) (string, error) {
 	resp := ""
 	b := [4096]byte{}
 	for {
-		n, err := d.conn.Read(b[:])
+		n, err := d.read(d.conn, b[:])
 		if resp += string(b[:n]); err != nil {
 			log.Printf("sendCommand(%q): %q; %s", cmd, resp, err)
 			return resp, err
 		}
+		if d.maxResponse > 0 && len(resp) > d.maxResponse {
+			log.Printf("sendCommand(%q): reply exceeds %d bytes", cmd, d.maxResponse)
+			return "", ErrResponseTooLarge
+		}
+		if !raw && isPartialReply(resp) {
+			// The reply can be split across multiple reads, e.g. M115.
+			continue
+		}
 		if n != len(b) {
 			break
 		}
 	}
-	// Verify the reponse, it should be wrapped.
-	c := strings.SplitN(cmd, " ", 2)[0]
-	prefix := "CMD " + c + " Received.\r\n"
-	if !strings.HasPrefix(resp, prefix) {
-		return resp, fmt.Errorf("unknown %s reply: %q", c, resp)
+	return resp, nil
+}
+
+// formatCmd assembles a command from its code and arguments, separated by
+// single spaces. Empty arguments are skipped.
+func formatCmd(code string, args ...string) string {
+	out := strings.TrimSpace(code)
+	for _, a := range args {
+		if a = strings.TrimSpace(a); a != "" {
+			out += " " + a
+		}
+	}
+	return out
+}
+
+// commandCode returns the command code the reply to cmd is wrapped with,
+// skipping a "N<line>" line number prefix, e.g. "G1" for "N12 G1 X1*97".
+func commandCode(cmd string) string {
+	f := strings.Fields(cmd)
+	if len(f) > 1 && len(f[0]) > 1 && f[0][0] == 'N' {
+		if _, err := strconv.Atoi(f[0][1:]); err == nil {
+			f = f[1:]
+		}
+	}
+	if len(f) == 0 {
+		return ""
+	}
+	code := f[0]
+	if i := strings.IndexByte(code, '*'); i != -1 {
+		code = code[:i]
+	}
+	return code
+}
+
+// firmwareError returns a *FirmwareError if the reply body contains an error
+// line.
+func firmwareError(cmd, body string) error {
+	for _, line := range splitLines(body) {
+		if strings.HasPrefix(line, "Error:") || strings.HasPrefix(line, "!!") {
+			return &FirmwareError{Cmd: cmd, Msg: line, Body: body}
+		}
+	}
+	return nil
+}
+
+// isPartialReply returns true if resp is the beginning of a wrapped reply
+// that is not yet terminated by "ok\r\n".
+func isPartialReply(resp string) bool {
+	if len(resp) < len("CMD ") {
+		return strings.HasPrefix("CMD ", resp)
+	}
+	return strings.HasPrefix(resp, "CMD ") && !hasOKSuffix(resp)
+}
+
+// hasOKSuffix returns true if s ends with the "ok" line terminating a wrapped
+// reply.
+//
+// Some firmware revisions use "\n" instead of "\r\n", so both are accepted.
+func hasOKSuffix(s string) bool {
+	return strings.HasSuffix(s, "\nok\r\n") || strings.HasSuffix(s, "\nok\n")
+}
+
+// okIndex returns the end of the first "ok" line terminating a wrapped reply
+// in s, or -1.
+func okIndex(s string) int {
+	end := -1
+	for _, t := range []string{"\nok\r\n", "\nok\n"} {
+		if i := strings.Index(s, t); i != -1 && (end == -1 || i+len(t) < end) {
+			end = i + len(t)
+		}
+	}
+	return end
+}
+
+// trimEOL removes one trailing "\r\n" or "\n".
+func trimEOL(s string) (string, bool) {
+	if strings.HasSuffix(s, "\r\n") {
+		return s[:len(s)-2], true
+	}
+	if strings.HasSuffix(s, "\n") {
+		return s[:len(s)-1], true
+	}
+	return s, false
+}
+
+// unwrapReply verifies the reply to the command code is wrapped in
+// "CMD X Received.\r\n" ... "ok\r\n" and returns the trimmed body.
+//
+// Bare "\n" line endings are accepted too. Some firmware echo the whole
+// command instead of its code, e.g. "CMD M146 r255 g255 b255 F0 Received.".
+func unwrapReply(code, resp string) (string, error) {
+	prefix := "CMD " + code
+	if !strings.HasPrefix(resp, prefix) || !hasOKSuffix(resp) {
+		return "", fmt.Errorf("unknown %s reply: %q", code, resp)
 	}
-	if !strings.HasSuffix(resp, "\r\nok\r\n") {
-		return resp, fmt.Errorf("unknown %s reply: %q", c, resp)
+	line := resp[len(prefix):]
+	i := strings.Index(line, " Received.")
+	if i == -1 || (i != 0 && line[0] != ' ') || strings.ContainsAny(line[:i], "\r\n") {
+		return "", fmt.Errorf("unknown %s reply: %q", code, resp)
 	}
 	// Trim the wrap. Create a copy to not keep unneeded data in memory.
-	line := string(resp[len(prefix) : len(resp)-len("ok\r\n")])
-	if strings.HasSuffix(line, "\r\n") {
-		line = line[:len(line)-len("\r\n")]
+	line = line[i+len(" Received."):]
+	if strings.HasPrefix(line, "\r\n") {
+		line = line[2:]
+	} else if strings.HasPrefix(line, "\n") {
+		line = line[1:]
+	} else {
+		return "", fmt.Errorf("unknown %s reply: %q", code, resp)
 	}
-	log.Printf("sendCommand(%q): %q", cmd, line)
-	return line, nil
+	line, _ = trimEOL(line)
+	if line = line[:len(line)-len("ok")]; line != "" {
+		var ok bool
+		if line, ok = trimEOL(line); !ok {
+			return "", fmt.Errorf("unknown %s reply: %q", code, resp)
+		}
+	}
+	return string(line), nil
+}
+
+// progressSample is a job progress observation.
+type progressSample struct {
+	when    time.Time
+	printed int64
+	total   int64
+}
+
+// shutdownOptions is the processed SafeShutdownOption list.
+type shutdownOptions struct {
+	home bool
+}
+
+// notifyOptions is the processed NotifyOption list.
+type notifyOptions struct {
+	hz       int
+	duration time.Duration
+}
+
+// Notify defaults.
+const (
+	notifyTone     = 1000
+	notifyDuration = 500 * time.Millisecond
+)
+
+// options is the processed Option list.
+type options struct {
+	dialTimeout   time.Duration
+	helloAttempts int
+	helloDelay    time.Duration
+	readPump      bool
+	keepHeating   bool
+	readOnly      bool
+	autoReconnect bool
+	unguardedRaw  bool
+	maxResponse   int
+}
+
+func newOptions(opts []Option) options {
+	o := options{dialTimeout: 3 * time.Second, helloAttempts: 1, maxResponse: defaultMaxResponse}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// mode is a tracked printer mode. It starts unknown since another client may
+// have changed it.
+type mode uint8
+
+const (
+	modeUnknown mode = iota
+	modeAbsolute
+	modeRelative
+)
+
+// deadliner is implemented by net.Conn.
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+// writeDeadliner is implemented by net.Conn.
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// writeDeadline adapts a writeDeadliner to only set the write deadline.
+type writeDeadline struct {
+	w writeDeadliner
+}
+
+func (w writeDeadline) SetDeadline(t time.Time) error {
+	return w.w.SetWriteDeadline(t)
+}
+
+// parsePosition parses a M114 reply.
+func parsePosition(resp string, p *Position) error {
+	re := regexp.MustCompile(`^X:(\-?\d+(?:\.\d+)) Y:(\-?\d+(?:\.\d+)) Z:(\-?\d+(?:\.\d+))(?: A:(\-?\d+(?:\.\d+)?))?(?: B:(\-?\d+(?:\.\d+)?))?$`)
+	lines := splitLines(resp)
+	if len(lines) != 1 {
+		return fmt.Errorf("unknown reply: %q", resp)
+	}
+	m := re.FindStringSubmatch(lines[0])
+	if m == nil {
+		return fmt.Errorf("unknown reply: %q", resp)
+	}
+	v, err := parseDistance(m[1])
+	if err != nil {
+		return err
+	}
+	p.X = v
+
+	if v, err = parseDistance(m[2]); err != nil {
+		return err
+	}
+	p.Y = v
+
+	if v, err = parseDistance(m[3]); err != nil {
+		return err
+	}
+	p.Z = v
+
+	p.A, p.B = 0, 0
+	if m[4] != "" {
+		if p.A, err = parseDistance(m[4]); err != nil {
+			return err
+		}
+	}
+	if m[5] != "" {
+		if p.B, err = parseDistance(m[5]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// defaultWriteTimeout is the default maximum time a write may block.
+const defaultWriteTimeout = 5 * time.Second
+
+// defaultMaxResponse is the default maximum size of a reply.
+const defaultMaxResponse = 1 << 20
+
+// closeTimeout is the time Close waits for the printer to release control.
+const closeTimeout = 5 * time.Second
+
+// fullStopTimeout is the time FullStop waits for the printer to acknowledge
+// M112.
+const fullStopTimeout = time.Second
+
+// tryConnectTimeout is the time TryConnect waits for a printer.
+const tryConnectTimeout = time.Second
+
+// maxFans is the number of fan indices accepted by M106 and M107. The known
+// firmware don't report their fans, so it is the limit unless
+// Capabilities.FanCount is set.
+const maxFans = 4
+
+// fadeUnit is the resolution of the M146 F parameter.
+const fadeUnit = 100 * time.Millisecond
+
+// fadeUnits converts a light fade duration to the M146 F units.
+func fadeUnits(fade time.Duration) (int64, error) {
+	if fade < 0 || fade > time.Minute {
+		return 0, fmt.Errorf("invalid fade %s: must be between 0 and 1m", fade)
+	}
+	return int64((fade + fadeUnit/2) / fadeUnit), nil
 }
 
 func parseDistance(s string) (physic.Distance, error) {
 	// It seems the printer handlers this as a float but handle as integer here.
+	if s == "" {
+		return 0, errors.New("empty distance")
+	}
 	neg := s[0] == '-'
 	if neg {
 		s = s[1:]
@@ -464,3 +2086,288 @@ func parseDistance(s string) (physic.Distance, error) {
 	}
 	return out, nil
 }
+
+// parseStatus parses a M119 reply.
+func parseStatus(resp string, s *Status) error {
+	s.HasDoorSensor, s.DoorOpen = false, false
+	for _, line := range splitLines(resp) {
+		switch {
+		case strings.HasPrefix(line, "Endstop: "):
+			re := regexp.MustCompile(`^Endstop: X-max:(\d+) Y-max:(\d+) Z-max:(\d+)$`)
+			m := re.FindStringSubmatch(line)
+			if m == nil {
+				return fmt.Errorf("unknown reply: %q", line)
+			}
+			var err error
+			if s.X, err = strconv.Atoi(m[1]); err != nil {
+				return err
+			}
+			if s.Y, err = strconv.Atoi(m[2]); err != nil {
+				return err
+			}
+			if s.Z, err = strconv.Atoi(m[3]); err != nil {
+				return err
+			}
+			s.XTriggered = s.X != 0
+			s.YTriggered = s.Y != 0
+			s.ZTriggered = s.Z != 0
+		case strings.HasPrefix(line, "MachineStatus: "):
+			// READY, BUILDING_FROM_SD, PAUSED
+			s.Status = line[len("MachineStatus: "):]
+		case strings.HasPrefix(line, "MoveMode: "):
+			// READY, MOVING, PAUSED
+			s.MoveMode = line[len("MoveMode: "):]
+		case strings.HasPrefix(line, "Status: "):
+			// TODO(maruel): Figure out "S:0 L:0 J:0 F:0".
+			s.Stuff = line[len("Status: "):]
+		case strings.HasPrefix(line, "Door: "):
+			// OPEN, CLOSED; or 1, 0
+			switch line[len("Door: "):] {
+			case "OPEN", "1":
+				s.DoorOpen = true
+			case "CLOSED", "0":
+				s.DoorOpen = false
+			default:
+				return fmt.Errorf("unknown reply: %q", line)
+			}
+			s.HasDoorSensor = true
+		default:
+			return fmt.Errorf("unknown reply: %q", line)
+		}
+	}
+	return nil
+}
+
+// parseToolOffset parses a M115 tool offset line, e.g.
+// "Tool 1 Offset: X: 20.5 Y: 0 Z: -0.1".
+func parseToolOffset(line string, i *Info) error {
+	re := regexp.MustCompile(`^Tool (\d+) Offset: X: ?(\-?\d+(?:\.\d+)?) Y: ?(\-?\d+(?:\.\d+)?) Z: ?(\-?\d+(?:\.\d+)?)$`)
+	m := re.FindStringSubmatch(line)
+	if m == nil {
+		return fmt.Errorf("unknown reply: %q", line)
+	}
+	t, err := strconv.Atoi(m[1])
+	if err != nil || t > 16 {
+		return fmt.Errorf("unknown reply: %q", line)
+	}
+	p := Position{}
+	if p.X, err = parseDistance(m[2]); err != nil {
+		return err
+	}
+	if p.Y, err = parseDistance(m[3]); err != nil {
+		return err
+	}
+	if p.Z, err = parseDistance(m[4]); err != nil {
+		return err
+	}
+	for len(i.ToolOffsets) <= t {
+		i.ToolOffsets = append(i.ToolOffsets, Position{})
+	}
+	i.ToolOffsets[t] = p
+	return nil
+}
+
+// parseUptime parses an uptime either in seconds, e.g. "93784", or in
+// components, e.g. "1d 2h 3m 4s".
+func parseUptime(s string) (time.Duration, error) {
+	if v, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return time.Duration(v) * time.Second, nil
+	}
+	units := map[byte]time.Duration{'d': 24 * time.Hour, 'h': time.Hour, 'm': time.Minute, 's': time.Second}
+	var out time.Duration
+	f := strings.Fields(s)
+	if len(f) == 0 {
+		return 0, fmt.Errorf("unknown uptime: %q", s)
+	}
+	for _, c := range f {
+		u, ok := units[c[len(c)-1]]
+		if !ok {
+			return 0, fmt.Errorf("unknown uptime: %q", s)
+		}
+		v, err := strconv.ParseUint(c[:len(c)-1], 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("unknown uptime: %q", s)
+		}
+		out += time.Duration(v) * u
+	}
+	return out, nil
+}
+
+// parseMesh parses a M420 V reply, e.g.:
+//
+//	Bilinear Leveling Grid:
+//	      0      1
+//	 0 +0.010 -0.020
+//	 1 +0.030 +0.000
+func parseMesh(resp string) ([][]physic.Distance, error) {
+	var mesh [][]physic.Distance
+	for _, line := range splitLines(resp) {
+		f := strings.Fields(line)
+		if len(f) < 2 {
+			continue
+		}
+		if _, err := strconv.Atoi(f[0]); err != nil || !strings.Contains(f[1], ".") {
+			// Title and column header.
+			continue
+		}
+		row := make([]physic.Distance, 0, len(f)-1)
+		for _, v := range f[1:] {
+			d, err := parseDistance(strings.TrimPrefix(v, "+"))
+			if err != nil {
+				return nil, fmt.Errorf("unknown reply: %q", line)
+			}
+			row = append(row, d)
+		}
+		if len(mesh) != 0 && len(row) != len(mesh[0]) {
+			return nil, fmt.Errorf("unknown reply: %q", line)
+		}
+		mesh = append(mesh, row)
+	}
+	if len(mesh) == 0 {
+		return nil, ErrUnsupported
+	}
+	return mesh, nil
+}
+
+// parseJob parses a M27 reply.
+func parseJob(resp string, j *Job) error {
+	j.Filename = ""
+	for _, line := range splitLines(resp) {
+		var err error
+		switch {
+		case strings.HasPrefix(line, "Current file: "):
+			j.Filename = line[len("Current file: "):]
+		case strings.HasPrefix(line, "CurrentFile: "):
+			j.Filename = line[len("CurrentFile: "):]
+		case strings.HasPrefix(line, "SD printing byte "):
+			// "SD printing byte 0/100"
+			j.Printed, j.Total, err = parseFraction(line[len("SD printing byte "):])
+		case strings.HasPrefix(line, "Layer: "):
+			// "Layer: 0/0"
+			j.Layer, j.LayerTotal, err = parseFraction(line[len("Layer: "):])
+		case line == "":
+		default:
+			return fmt.Errorf("unknown reply: %q", line)
+		}
+		if err != nil {
+			return fmt.Errorf("unknown reply: %q", line)
+		}
+	}
+	return nil
+}
+
+// parseFraction parses "<a>/<b>".
+func parseFraction(s string) (int64, int64, error) {
+	i := strings.IndexByte(s, '/')
+	if i == -1 {
+		return 0, 0, fmt.Errorf("invalid fraction %q", s)
+	}
+	a, err := strconv.ParseInt(s[:i], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	b, err := strconv.ParseInt(s[i+1:], 10, 64)
+	return a, b, err
+}
+
+// parseTemp parses a M105 reply into t and returns whether a bed and a chamber
+// reading were present.
+func parseTemp(resp string, t *Temperatures) (bool, bool, error) {
+	// "T0:22 /0 B:17/0". The firmware puts a space before the slash for the
+	// extruder but not for the bed.
+	*t = Temperatures{}
+	hasExtruder := false
+	hasBed := false
+	hasChamber := false
+	for _, f := range strings.Fields(strings.ReplaceAll(strings.Join(splitLines(resp), " "), " /", "/")) {
+		i := strings.IndexByte(f, ':')
+		if i == -1 {
+			return false, false, fmt.Errorf("unknown reply: %q", resp)
+		}
+		cur := f[i+1:]
+		// target stays 0K when not reported.
+		var target physic.Temperature
+		if j := strings.IndexByte(cur, '/'); j != -1 {
+			var err error
+			if target, err = parseTemperature(cur[j+1:]); err != nil {
+				return false, false, fmt.Errorf("unknown reply: %q", resp)
+			}
+			cur = cur[:j]
+		}
+		v, err := parseTemperature(cur)
+		if err != nil {
+			return false, false, fmt.Errorf("unknown reply: %q", resp)
+		}
+		switch k := f[:i]; {
+		case k == "T" || k == "T0":
+			t.Extruder, t.ExtruderTarget = v, target
+			hasExtruder = true
+		case strings.HasPrefix(k, "T"):
+			// Ignore the other extruders for now.
+		case k == "B":
+			t.Bed, t.BedTarget = v, target
+			hasBed = true
+		case k == "C":
+			t.Chamber, t.ChamberTarget = v, target
+			hasChamber = true
+		default:
+			return false, false, fmt.Errorf("unknown reply: %q", resp)
+		}
+	}
+	if !hasExtruder {
+		return false, false, fmt.Errorf("missing extruder temperature: %q", resp)
+	}
+	return hasBed, hasChamber, nil
+}
+
+// splitLines splits a reply into lines, accepting "\r\n", "\n" and "\r" as
+// line endings. Trailing empty lines are removed.
+func splitLines(resp string) []string {
+	resp = strings.ReplaceAll(resp, "\r\n", "\n")
+	resp = strings.ReplaceAll(resp, "\r", "\n")
+	lines := strings.Split(resp, "\n")
+	for len(lines) != 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// parseTemperature parses a temperature in Celsius as reported by the printer,
+// e.g. "0", "22" or "210.5".
+func parseTemperature(s string) (physic.Temperature, error) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	// Reject anything below absolute zero.
+	if math.IsNaN(v) || math.IsInf(v, 0) || v < -273.15 {
+		return 0, fmt.Errorf("invalid temperature %q", s)
+	}
+	return physic.ZeroCelsius + physic.Temperature(math.Round(v*float64(physic.Celsius))), nil
+}
+
+// distanceToMM converts a distance to millimetres, rounded to the micrometre.
+func distanceToMM(d physic.Distance) float64 {
+	return math.Round(float64(d)/float64(physic.MicroMetre)) / 1000
+}
+
+// mmToDistance converts millimetres to a distance, rounded to the nanometre.
+func mmToDistance(mm float64) physic.Distance {
+	return physic.Distance(math.Round(mm * float64(physic.MilliMetre)))
+}
+
+// speedToMMPerMin converts a speed to the millimetres per minute used by G1's F
+// parameter, rounded to the nearest integer.
+func speedToMMPerMin(s physic.Speed) int {
+	return int(math.Round(float64(s) * 60 / float64(physic.MilliMetrePerSecond)))
+}
+
+// formatMM formats a distance for a G-code parameter, e.g. "10.5".
+func formatMM(d physic.Distance) string {
+	return strconv.FormatFloat(distanceToMM(d), 'f', -1, 64)
+}
+
+// toCelsius converts a temperature to the integer Celsius the printer expects.
+func toCelsius(t physic.Temperature) int {
+	return int(math.Round(t.Celsius()))
+}
@@ -0,0 +1,1625 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package ffa3
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"periph.io/x/conn/v3/physic"
+)
+
+func TestQueryTemp(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.set("M105", "T0:210.5 /210 B:60/60")
+	got := Temperatures{}
+	if err := d.QueryTemp(&got); err != nil {
+		t.Fatal(err)
+	}
+	want := Temperatures{Extruder: celsius(210.5), Bed: celsius(60), ExtruderTarget: celsius(210), BedTarget: celsius(60)}
+	if got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	f.set("M105", "garbage")
+	if err := d.QueryTemp(&got); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestSendHello_Busy(t *testing.T) {
+	f := newFakePrinter(t)
+	f.set("M601", "Control failed.")
+	d := &Dev{conn: f.client}
+	if err := d.sendHello(context.Background()); !errors.Is(err, ErrBusy) {
+		t.Fatal(err)
+	}
+	f.set("M601", "Who are you?")
+	if err := d.sendHello(context.Background()); err == nil || errors.Is(err, ErrBusy) {
+		t.Fatal(err)
+	}
+}
+
+func TestConnect_Retry(t *testing.T) {
+	f := listenFakePrinter(t)
+	f.set("M601", "Control failed.", "Control Success.")
+	d, err := Connect("127.0.0.1", WithConnectRetry(2, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := f.received(); len(got) < 2 || got[0] != "M601 S1" || got[1] != "M601 S1" {
+		t.Fatalf("unexpected commands %q", got)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnect_Busy(t *testing.T) {
+	f := listenFakePrinter(t)
+	f.set("M601", "Control failed.")
+	if _, err := Connect("127.0.0.1"); err != ErrBusy {
+		t.Fatal(err)
+	}
+	// Control was not taken so it is not released.
+	if want := []string{"M601 S1"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+}
+
+func TestTryConnect(t *testing.T) {
+	listenFakePrinter(t)
+	d, err := TryConnect(context.Background(), "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing listens there.
+	start := time.Now()
+	if _, err := TryConnect(context.Background(), "127.0.0.2"); err == nil {
+		t.Fatal("expected error")
+	}
+	if d := time.Since(start); d > 2*tryConnectTimeout {
+		t.Fatalf("took %s", d)
+	}
+}
+
+func TestTryConnect_Silent(t *testing.T) {
+	f := listenFakePrinter(t)
+	for _, code := range []string{"M601", "M115"} {
+		// The peer accepts the connection but never replies.
+		f.reset()
+		f.mu.Lock()
+		f.custom = map[string]func(w io.Writer){code: func(w io.Writer) {}}
+		f.mu.Unlock()
+		start := time.Now()
+		if _, err := TryConnect(context.Background(), "127.0.0.1"); err == nil {
+			t.Fatalf("%s: expected error", code)
+		}
+		if d := time.Since(start); d > 2*tryConnectTimeout {
+			t.Fatalf("%s: took %s", code, d)
+		}
+		for _, cmd := range f.received() {
+			if cmd == "M602" {
+				t.Fatalf("%s: unexpected %q", code, f.received())
+			}
+		}
+	}
+}
+
+func TestSetChamberTemperature(t *testing.T) {
+	f := newFakePrinter(t)
+	f.set("M105", "T0:22 /0 B:17/0 C:25/0")
+	d := f.connect()
+	f.reset()
+	if err := d.SetChamberTemperature(celsius(40)); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"M141 S40"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+}
+
+func TestSetChamberTemperature_Unsupported(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	if err := d.SetChamberTemperature(celsius(40)); err != ErrUnsupported {
+		t.Fatal(err)
+	}
+	if got := f.received(); len(got) != 0 {
+		t.Fatalf("unexpected commands %q", got)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	f := newFakePrinter(t)
+	f.set("M115", "Machine Type: Flashforge Adventurer III\r\nTool Count: 1")
+	f.set("M105", "T0:22 /0 B:17/0 C:25/0")
+	f.set("M119", "Endstop: X-max:0 Y-max:0 Z-max:0\r\nMachineStatus: READY\r\nMoveMode: READY\r\nStatus: S:0 L:0 J:0 F:0")
+	d := f.connect()
+	mm := physic.MilliMetre
+	want := Capabilities{
+		HasHeatedBed: true, HasChamber: true, HasFilamentSensor: true, ExtruderCount: 1,
+		Model: "Adventurer 3", BuildX: 150 * mm, BuildY: 150 * mm, BuildZ: 150 * mm,
+		MaxExtruderTemp: maxExtruderTemp, MaxBedTemp: maxBedTemp,
+	}
+	got := d.Capabilities()
+	if !got.Supports("M140") || !got.Supports("m141 S40") || got.Supports("M999") {
+		t.Fatal("unexpected supported commands")
+	}
+	if got.commands = nil; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	if want := []string{"M601 S1", "M115", "M105", "M119"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+
+	f = newFakePrinter(t)
+	f.set("M105", "T0:22 /0")
+	f.set("M119", "MachineStatus: READY")
+	want = Capabilities{
+		Model: "Adventurer 3", BuildX: 150 * mm, BuildY: 150 * mm, BuildZ: 150 * mm,
+		MaxExtruderTemp: maxExtruderTemp, MaxBedTemp: maxBedTemp,
+	}
+	d = f.connect()
+	if got = d.Capabilities(); got.Supports("M140") || got.Supports("M141") || !got.Supports("M105") {
+		t.Fatal("unexpected supported commands")
+	}
+	if got.commands = nil; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	// The heaters missing are not driven.
+	f.reset()
+	if err := d.SetBedTemperature(celsius(60)); err != ErrUnsupported {
+		t.Fatal(err)
+	}
+	if err := d.SetChamberTemperature(celsius(40)); err != ErrUnsupported {
+		t.Fatal(err)
+	}
+	if got := f.received(); len(got) != 0 {
+		t.Fatalf("unexpected commands %q", got)
+	}
+}
+
+func TestAutoHome(t *testing.T) {
+	f := newFakePrinter(t)
+	f.set("M114", "X:1.5 Y:-2.25 Z:10.0 A:0 B:0")
+	d := f.connect()
+	f.reset()
+	p, err := d.AutoHome(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Position{X: 1500 * physic.MicroMetre, Y: -2250 * physic.MicroMetre, Z: 10 * physic.MilliMetre}); p != want {
+		t.Fatalf("got %+v, want %+v", p, want)
+	}
+	if want := []string{"G28", "M114"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	f.reset()
+	if _, err := d.AutoHome(ctx); err != context.Canceled {
+		t.Fatal(err)
+	}
+	if got := f.received(); len(got) != 0 {
+		t.Fatalf("unexpected commands %q", got)
+	}
+}
+
+func TestAutoHome_LateOK(t *testing.T) {
+	// The printer acknowledges G28 right away but only sends "ok" once homing
+	// is done.
+	f := newFakePrinter(t)
+	f.custom["G28"] = func(w io.Writer) {
+		w.Write([]byte("CMD G28 Received.\r\n"))
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("ok\r\n"))
+	}
+	f.set("M114", "X:1.0 Y:2.0 Z:3.0")
+	d := f.connect()
+	p, err := d.AutoHome(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Z != 3*physic.MilliMetre {
+		t.Fatal(p)
+	}
+	// The late ok must not be glued to the next reply.
+	if err := d.QueryTemp(&Temperatures{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParsePosition(t *testing.T) {
+	mm := physic.MilliMetre
+	data := []struct {
+		in   string
+		want Position
+		err  bool
+	}{
+		{in: "X:1.5 Y:-2.25 Z:10.0 A:0 B:0", want: Position{X: 1500 * physic.MicroMetre, Y: -2250 * physic.MicroMetre, Z: 10 * mm}},
+		{in: "X:1.5 Y:-2.25 Z:10.0", want: Position{X: 1500 * physic.MicroMetre, Y: -2250 * physic.MicroMetre, Z: 10 * mm}},
+		{in: "X:0.0 Y:0.0 Z:0.0 A:3 B:4.5", want: Position{A: 3 * mm, B: 4500 * physic.MicroMetre}},
+		{in: "X:1 Y:2 Z:3 A:0 B:0", err: true},
+		{in: "", err: true},
+	}
+	for i, line := range data {
+		got := Position{}
+		err := parsePosition(line.in, &got)
+		if (err != nil) != line.err {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if err == nil && got != line.want {
+			t.Fatalf("#%d: got %+v, want %+v", i, got, line.want)
+		}
+	}
+}
+
+func TestSetPositioningMode(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	for _, abs := range []bool{true, true, false, false, true} {
+		if err := d.SetPositioningMode(abs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// SendRawCommand keeps the tracked mode in sync.
+	if _, err := d.SendRawCommand("G91"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetPositioningMode(false); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"G90", "G91", "G90", "G91"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+}
+
+func TestFanSpeed(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	if _, err := d.FanSpeed(0); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := d.SetFanSpeed(0, 128); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := d.FanSpeed(0); s != 128 || err != nil {
+		t.Fatal(s, err)
+	}
+	if err := d.SetFanSpeed(1, 64); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetFan(false); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := d.FanSpeed(0); s != 0 || err != nil {
+		t.Fatal(s, err)
+	}
+	// Each fan is tracked separately.
+	if s, err := d.FanSpeed(1); s != 64 || err != nil {
+		t.Fatal(s, err)
+	}
+	if err := d.SetFanSpeed(maxFans, 1); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := d.FanSpeed(-1); err == nil {
+		t.Fatal("expected error")
+	}
+	if want := []string{"M106 P0 S128", "M106 P1 S64", "M107 P0"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+}
+
+func TestFanSpeed_FanCount(t *testing.T) {
+	f := newFakePrinter(t)
+	f.set("M115", "Machine Type: Flashforge Adventurer III\r\nFan Count: 1")
+	d := f.connect()
+	if n := d.Capabilities().FanCount; n != 1 {
+		t.Fatalf("got %d fans", n)
+	}
+	f.reset()
+	if err := d.SetFanSpeed(1, 64); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := d.FanSpeed(1); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := d.SetFanSpeed(0, 64); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"M106 P0 S64"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+}
+
+func TestLightColor(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	if _, _, _, err := d.LightColor(); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := d.SetLightColor(255, 128, 0); err != nil {
+		t.Fatal(err)
+	}
+	if r, g, b, err := d.LightColor(); r != 255 || g != 128 || b != 0 || err != nil {
+		t.Fatal(r, g, b, err)
+	}
+	if err := d.SetLight(false); err != nil {
+		t.Fatal(err)
+	}
+	if r, g, b, err := d.LightColor(); r != 0 || g != 0 || b != 0 || err != nil {
+		t.Fatal(r, g, b, err)
+	}
+	if want := []string{"M146 r255 g128 b0 F0", "M146 r0 g0 b0 F0"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+}
+
+func TestNewDev_BusyRetry(t *testing.T) {
+	f := newFakePrinter(t)
+	f.set("M601", "Control failed.", "Control Success.")
+	d, err := NewDev(context.Background(), f.client, WithConnectRetry(2, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := f.received(); got[0] != "M601 S1" || got[1] != "M601 S1" {
+		t.Fatalf("unexpected commands %q", got)
+	}
+	if d.Conn() != f.client {
+		t.Fatal("unexpected Conn")
+	}
+}
+
+func TestNewDev_Busy(t *testing.T) {
+	f := newFakePrinter(t)
+	f.set("M601", "Control failed.")
+	if _, err := NewDev(context.Background(), f.client); err != ErrBusy {
+		t.Fatal(err)
+	}
+}
+
+func TestSetName(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	f.set("M115", "Machine Type: Flashforge Adventurer III\r\nMachine Name: shop")
+	if err := d.SetName("shop"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"M610 shop", "M115"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+	// The printer didn't take the new name.
+	if err := d.SetName("garage"); err == nil {
+		t.Fatal("expected error")
+	}
+	f.reset()
+	for _, name := range []string{"", strings.Repeat("a", 33), "a~b", "café", "a\nb"} {
+		if err := d.SetName(name); err == nil {
+			t.Fatalf("%q: expected error", name)
+		}
+	}
+	if got := f.received(); len(got) != 0 {
+		t.Fatalf("unexpected commands %q", got)
+	}
+}
+
+func TestParseStatus(t *testing.T) {
+	data := []struct {
+		in   string
+		want Status
+		err  bool
+	}{
+		{
+			in: "Endstop: X-max:0 Y-max:1 Z-max:0\r\nMachineStatus: READY\r\nMoveMode: READY\r\nStatus: S:0 L:0 J:0 F:0",
+			want: Status{
+				Y: 1, YTriggered: true, Status: "READY", MoveMode: "READY", Stuff: "S:0 L:0 J:0 F:0",
+			},
+		},
+		{in: "MachineStatus: BUILDING_FROM_SD", want: Status{Status: "BUILDING_FROM_SD"}},
+		{in: "Endstop: X-max:a Y-max:1 Z-max:0", err: true},
+		{in: "Unknown: 1", err: true},
+	}
+	for i, line := range data {
+		got := Status{}
+		err := parseStatus(line.in, &got)
+		if (err != nil) != line.err {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if err == nil && got != line.want {
+			t.Fatalf("#%d: got %+v, want %+v", i, got, line.want)
+		}
+	}
+	s := Status{}
+	if err := parseStatus("Endstop: X-max:1 Y-max:1 Z-max:1", &s); err != nil || !s.AtHome() {
+		t.Fatalf("%v %+v", err, s)
+	}
+}
+
+func TestFullStop(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	if err := d.FullStop(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"M112"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+	// The wrap is not stripped.
+	resp, err := d.sendCommandRaw("M112")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "CMD M112 Received.\r\nok\r\n"; resp != want {
+		t.Fatalf("got %q, want %q", resp, want)
+	}
+}
+
+func TestFullStop_NoAck(t *testing.T) {
+	for _, pump := range []bool{false, true} {
+		f := newFakePrinter(t)
+		var opts []Option
+		if pump {
+			opts = append(opts, WithReadPump())
+		}
+		// The firmware halts without replying.
+		f.custom["M112"] = func(w io.Writer) {}
+		d := f.connect(opts...)
+		start := time.Now()
+		if err := d.FullStop(); err != nil {
+			t.Fatalf("pump=%t: %v", pump, err)
+		}
+		if dur := time.Since(start); dur > 2*fullStopTimeout {
+			t.Fatalf("pump=%t: took %s", pump, dur)
+		}
+		// d.mu was released.
+		if err := d.QueryTemp(&Temperatures{}); err != nil {
+			t.Fatalf("pump=%t: %v", pump, err)
+		}
+	}
+}
+
+func TestFullStop_Closed(t *testing.T) {
+	f := newFakePrinter(t)
+	// The firmware drops the connection as it halts.
+	f.custom["M112"] = func(w io.Writer) { w.(io.Closer).Close() }
+	d := f.connect()
+	if err := d.FullStop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPauseAtHeight(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	f.set("M114", "X:0.0 Y:0.0 Z:1.0 A:0 B:0", "X:0.0 Y:0.0 Z:5.0 A:0 B:0")
+	f.set("M119", "MachineStatus: BUILDING_FROM_SD")
+	if err := d.PauseAtHeight(context.Background(), 5*physic.MilliMetre, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.ResumeJob(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"M114", "M119", "M114", "M25", "M24"}
+	if got := f.received(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	// The nozzle starts above z, e.g. after homing; it only pauses once it
+	// went below and rose back.
+	f.reset()
+	f.set("M114", "X:0.0 Y:0.0 Z:150.0 A:0 B:0", "X:0.0 Y:0.0 Z:0.3 A:0 B:0", "X:0.0 Y:0.0 Z:5.0 A:0 B:0")
+	if err := d.PauseAtHeight(context.Background(), 5*physic.MilliMetre, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"M114", "M119", "M114", "M119", "M114", "M25"}
+	if got := f.received(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	// The job ends first.
+	f.set("M114", "X:0.0 Y:0.0 Z:1.0 A:0 B:0")
+	f.set("M119", "MachineStatus: READY")
+	if err := d.PauseAtHeight(context.Background(), 5*physic.MilliMetre, time.Millisecond); err == nil {
+		t.Fatal("expected error")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	f.set("M119", "MachineStatus: BUILDING_FROM_SD")
+	if err := d.PauseAtHeight(ctx, 5*physic.MilliMetre, time.Millisecond); err != context.Canceled {
+		t.Fatal(err)
+	}
+}
+
+func TestIsPrinting(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	data := []struct {
+		status string
+		want   bool
+	}{
+		{"MachineStatus: READY", false},
+		{"MachineStatus: BUILDING_FROM_SD", true},
+		{"MachineStatus: PAUSED", true},
+	}
+	for i, line := range data {
+		f.set("M119", line.status)
+		if got, err := d.IsPrinting(); got != line.want || err != nil {
+			t.Fatalf("#%d: got %t %v", i, got, err)
+		}
+	}
+}
+
+func TestDoorOpen(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	if _, err := d.DoorOpen(); err != ErrUnsupported {
+		t.Fatal(err)
+	}
+	data := []struct {
+		door string
+		want bool
+	}{
+		{"OPEN", true},
+		{"CLOSED", false},
+		{"1", true},
+		{"0", false},
+	}
+	for i, line := range data {
+		f.set("M119", "MachineStatus: READY\r\nDoor: "+line.door)
+		if got, err := d.DoorOpen(); got != line.want || err != nil {
+			t.Fatalf("#%d: got %t %v", i, got, err)
+		}
+	}
+	f.set("M119", "MachineStatus: READY\r\nDoor: AJAR")
+	if _, err := d.DoorOpen(); err == nil || err == ErrUnsupported {
+		t.Fatal(err)
+	}
+}
+
+func TestParseJob(t *testing.T) {
+	data := []struct {
+		in   string
+		want Job
+		err  bool
+	}{
+		{in: "SD printing byte 10/100\r\nLayer: 3/20", want: Job{Printed: 10, Total: 100, Layer: 3, LayerTotal: 20}},
+		{in: "Current file: benchy.gx\r\nSD printing byte 0/100", want: Job{Total: 100, Filename: "benchy.gx"}},
+		{in: "CurrentFile: cube.gx", want: Job{Filename: "cube.gx"}},
+		{in: "SD printing byte 10", err: true},
+		{in: "Layer: a/2", err: true},
+		{in: "Unknown", err: true},
+	}
+	for i, line := range data {
+		got := Job{Filename: "stale"}
+		err := parseJob(line.in, &got)
+		if (err != nil) != line.err {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if err == nil && got != line.want {
+			t.Fatalf("#%d: got %+v, want %+v", i, got, line.want)
+		}
+	}
+}
+
+func TestSubscribeJobStatus(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	f.set("M27", "SD printing byte 10/100")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, err := d.SubscribeJobStatus(ctx, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j := <-c; j.Printed != 10 {
+		t.Fatalf("unexpected %+v", j)
+	}
+	f.push("CMD M27 Received.\r\nSD printing byte 20/100\r\nok\r\n")
+	if j := <-c; j.Printed != 20 {
+		t.Fatalf("unexpected %+v", j)
+	}
+	cancel()
+	for range c {
+	}
+	// The auto report is disabled once done.
+	if want := []string{"M27 S2", "M27 S0"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+}
+
+func TestConversions(t *testing.T) {
+	if got := formatMM(1500 * physic.MicroMetre); got != "1.5" {
+		t.Fatal(got)
+	}
+	if got := formatMM(-70 * physic.MilliMetre); got != "-70" {
+		t.Fatal(got)
+	}
+	if got := distanceToMM(2500 * physic.MicroMetre); got != 2.5 {
+		t.Fatal(got)
+	}
+	if got := mmToDistance(0.3); got != 300*physic.MicroMetre {
+		t.Fatal(got)
+	}
+	if got := speedToMMPerMin(50 * physic.MilliMetrePerSecond); got != 3000 {
+		t.Fatal(got)
+	}
+	if got := toCelsius(physic.ZeroCelsius + 210*physic.Celsius); got != 210 {
+		t.Fatal(got)
+	}
+}
+
+func TestMove(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	mm := physic.MilliMetre
+	if err := d.MoveTo(10*mm, 20*mm, 1500*physic.MicroMetre, 50*physic.MilliMetrePerSecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.MoveBy(-mm, 0, 0, 50*physic.MilliMetrePerSecond); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"G90", "G1 X10 Y20 Z1.5 F3000", "G91", "G1 X-1 Y0 Z0 F3000"}
+	if got := f.received(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestExtrude(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	if _, err := d.ExtrusionMode(); err == nil {
+		t.Fatal("expected error")
+	}
+	mm := physic.MilliMetre
+	// The mode is unknown, it is left relative.
+	if err := d.Extrude(5*mm, 5*physic.MilliMetrePerSecond); err != nil {
+		t.Fatal(err)
+	}
+	if rel, err := d.ExtrusionMode(); !rel || err != nil {
+		t.Fatal(rel, err)
+	}
+	// G90 also sets absolute extrusion, which is restored.
+	if err := d.SetPositioningMode(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Extrude(-2*mm, 5*physic.MilliMetrePerSecond); err != nil {
+		t.Fatal(err)
+	}
+	if rel, err := d.ExtrusionMode(); rel || err != nil {
+		t.Fatal(rel, err)
+	}
+	// Only a change is sent.
+	if err := d.SetExtrusionMode(false); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"M83", "G1 E5 F300", "G90", "M83", "G1 E-2 F300", "M82"}
+	if got := f.received(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestParseTemp(t *testing.T) {
+	data := []struct {
+		in   string
+		want Temperatures
+		err  bool
+	}{
+		{in: "T0:22 /0 B:17/0", want: Temperatures{Extruder: celsius(22), Bed: celsius(17), ExtruderTarget: celsius(0), BedTarget: celsius(0)}},
+		{in: "T0:0 /0", want: Temperatures{Extruder: celsius(0), ExtruderTarget: celsius(0)}},
+		{in: "T0:200 /210 B:60/55 C:30/40", want: Temperatures{Extruder: celsius(200), Bed: celsius(60), Chamber: celsius(30), ExtruderTarget: celsius(210), BedTarget: celsius(55), ChamberTarget: celsius(40)}},
+		// The target is not always reported.
+		{in: "T0:22", want: Temperatures{Extruder: celsius(22)}},
+		{in: "T0:22 /x", err: true},
+		{in: "B:17/0", err: true},
+		{in: "T0:-300 /0", err: true},
+		{in: "T0:NaN /0", err: true},
+	}
+	for i, line := range data {
+		got := Temperatures{Bed: celsius(99)}
+		_, _, err := parseTemp(line.in, &got)
+		if (err != nil) != line.err {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if err == nil && got != line.want {
+			t.Fatalf("#%d: got %+v, want %+v", i, got, line.want)
+		}
+	}
+}
+
+func TestWithDialTimeout(t *testing.T) {
+	if o := newOptions(nil); o.dialTimeout != 3*time.Second {
+		t.Fatal(o.dialTimeout)
+	}
+	// 192.0.2.0/24 is reserved for documentation, nothing answers there.
+	start := time.Now()
+	_, err := Connect("192.0.2.1", WithDialTimeout(50*time.Millisecond))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if !strings.HasPrefix(err.Error(), "failed to connect to 192.0.2.1: ") {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("took %s", d)
+	}
+}
+
+func TestFormatCmd(t *testing.T) {
+	data := []struct {
+		code string
+		args []string
+		want string
+	}{
+		{"M105", nil, "M105"},
+		{"M104", []string{"S200", "T0"}, "M104 S200 T0"},
+		{" G1 ", []string{"", " X1 ", "", "F60"}, "G1 X1 F60"},
+	}
+	for i, line := range data {
+		if got := formatCmd(line.code, line.args...); got != line.want {
+			t.Fatalf("#%d: got %q, want %q", i, got, line.want)
+		}
+	}
+}
+
+func TestIsPartialReply(t *testing.T) {
+	data := []struct {
+		in   string
+		want bool
+	}{
+		{"", true},
+		{"CM", true},
+		{"CMD M115 Received.\r\nMachine", true},
+		{"CMD M115 Received.\r\nok\r\n", false},
+		{"CMD M115 Received.\nMachine\nok\n", false},
+		{"garbage", false},
+	}
+	for i, line := range data {
+		if got := isPartialReply(line.in); got != line.want {
+			t.Fatalf("#%d: got %t", i, got)
+		}
+	}
+}
+
+func TestUnwrapReply(t *testing.T) {
+	data := []struct {
+		in   string
+		want string
+		err  bool
+	}{
+		{in: "CMD M105 Received.\r\nT0:22 /0\r\nok\r\n", want: "T0:22 /0"},
+		{in: "CMD M105 Received.\r\nok\r\n", want: ""},
+		{in: "CMD M105 Received.\nT0:22 /0\nok\n", want: "T0:22 /0"},
+		{in: "CMD M105 Received.\nok\n", want: ""},
+		{in: "CMD M105 Received.\r\nT0:22\nB:17\r\nok\n", want: "T0:22\nB:17"},
+		{in: "CMD M105 S1 T0 Received.\r\nT0:22 /0\r\nok\r\n", want: "T0:22 /0"},
+		{in: "CMD M105 Received.T0:22\r\nok\r\n", err: true},
+		{in: "CMD M1050 Received.\r\nok\r\n", err: true},
+		{in: "CMD M105\r\nX Received.\r\nok\r\n", err: true},
+		{in: "CMD M115 Received.\r\nok\r\n", err: true},
+		{in: "CMD M105 Received.\r\nT0:22", err: true},
+	}
+	for i, line := range data {
+		got, err := unwrapReply("M105", line.in)
+		if (err != nil) != line.err || got != line.want {
+			t.Fatalf("#%d: got %q %v", i, got, err)
+		}
+	}
+}
+
+func TestSendCommand_SplitReply(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		r := bufio.NewReader(server)
+		if _, err := r.ReadString('\n'); err != nil {
+			return
+		}
+		server.Write([]byte("CMD M115 Received.\r\nMachine Type: "))
+		server.Write([]byte("Flashforge Adventurer III\r\nok\r\n"))
+	}()
+	d := &Dev{conn: client}
+	resp, err := d.sendCommand("M115")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp != "Machine Type: Flashforge Adventurer III" {
+		t.Fatalf("unexpected %q", resp)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect(WithReadOnly())
+	if err := d.SetLight(true); err != ErrReadOnly {
+		t.Fatal(err)
+	}
+	if _, err := d.SendRawCommand("M146 r0 g0 b0 F0"); err != ErrReadOnly {
+		t.Fatal(err)
+	}
+	if err := d.SetExtruderTemperature(celsius(200)); err != ErrReadOnly {
+		t.Fatal(err)
+	}
+	if err := d.UploadGCode(context.Background(), "test.gcode", strings.NewReader("G28\n"), 4); err != ErrReadOnly {
+		t.Fatal(err)
+	}
+	if err := d.QueryTemp(&Temperatures{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Control is neither taken nor released.
+	if want := []string{"M115", "M105", "M119", "M105"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+}
+
+func TestReadOnly_UnguardedRaw(t *testing.T) {
+	f := newFakePrinter(t)
+	f.set("M650", "X: 1 Y: 0.5")
+	d := f.connect(WithReadOnly(), WithUnguardedRaw())
+	f.reset()
+	if resp, err := d.SendRawCommand("M650"); err != nil || resp != "X: 1 Y: 0.5" {
+		t.Fatal(resp, err)
+	}
+	// The other methods stay guarded.
+	if err := d.SetLight(true); err != ErrReadOnly {
+		t.Fatal(err)
+	}
+	if want := []string{"M650"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+}
+
+func TestFirmwareError(t *testing.T) {
+	f := newFakePrinter(t)
+	f.set("M650", "Error: Unknown command")
+	f.set("M651", "!! bad")
+	d := f.connect()
+	for _, cmd := range []string{"M650", "M651"} {
+		_, err := d.SendRawCommand(cmd)
+		var fe *FirmwareError
+		if !errors.As(err, &fe) || fe.Cmd != cmd {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+	}
+	if _, err := d.SendRawCommand("M105"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClose_Twice(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	for i := 0; i < 2; i++ {
+		if err := d.Close(); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	if err := d.QueryTemp(&Temperatures{}); err != ErrClosed {
+		t.Fatal(err)
+	}
+	if want := []string{"M602"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+}
+
+func TestCloseContext_Silent(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	// The printer stops replying.
+	client, server := net.Pipe()
+	defer server.Close()
+	go ioutil.ReadAll(server)
+	d.conn = client
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := d.CloseContext(ctx); err == nil {
+		t.Fatal("expected error")
+	}
+	if d := time.Since(start); d > closeTimeout/2 {
+		t.Fatalf("took %s", d)
+	}
+	// The connection is closed anyway.
+	if _, err := client.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Fatal(err)
+	}
+	if d.State() != StateDisconnected {
+		t.Fatal(d.State())
+	}
+}
+
+func TestSetWriteTimeout(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	// The printer stops reading.
+	client, server := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	d.conn = client
+	d.SetWriteTimeout(50 * time.Millisecond)
+	start := time.Now()
+	err := d.QueryTemp(&Temperatures{})
+	if err == nil || !strings.HasPrefix(err.Error(), "write timed out after 50ms: ") {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("took %s", d)
+	}
+}
+
+func TestWithMaxResponseBytes(t *testing.T) {
+	f := newFakePrinter(t)
+	f.set("M650", strings.Repeat("x", 200))
+	d := f.connect(WithMaxResponseBytes(100))
+	if _, err := d.SendRawCommand("M650"); err != ErrResponseTooLarge {
+		t.Fatal(err)
+	}
+	if d.State() != StateError {
+		t.Fatal(d.State())
+	}
+	// The default is generous.
+	f = newFakePrinter(t)
+	f.set("M650", strings.Repeat("x", 200))
+	if _, err := f.connect().SendRawCommand("M650"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWithMaxResponseBytes_Pump(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect(WithReadPump(), WithMaxResponseBytes(100))
+	// A reply that never ends.
+	f.push("CMD M650 Received.\r\n" + strings.Repeat("x", 200))
+	if _, ok := <-d.Pushes(); ok {
+		t.Fatal("pushes is not closed")
+	}
+	if err := d.QueryTemp(&Temperatures{}); err != ErrResponseTooLarge {
+		t.Fatal(err)
+	}
+}
+
+func TestLastResponse(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithReadPump()}} {
+		f := newFakePrinter(t)
+		d := f.connect(opts...)
+		f.set("M105", "garbage")
+		if err := d.QueryTemp(&Temperatures{}); err == nil {
+			t.Fatal("expected error")
+		}
+		if got := d.LastResponse(); got != "CMD M105 Received.\r\ngarbage\r\nok\r\n" {
+			t.Fatalf("%v: %q", opts, got)
+		}
+	}
+}
+
+func TestTeeTo(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithReadPump()}} {
+		f := newFakePrinter(t)
+		d := f.connect(opts...)
+		var buf bytes.Buffer
+		d.TeeTo(&buf)
+		if err := d.QueryTemp(&Temperatures{}); err != nil {
+			t.Fatal(err)
+		}
+		d.TeeTo(nil)
+		if err := d.QueryTemp(&Temperatures{}); err != nil {
+			t.Fatal(err)
+		}
+		if want := "~M105\nCMD M105 Received.\r\nT0:22 /0 B:17/0\r\nok\r\n"; buf.String() != want {
+			t.Fatalf("%v: got %q, want %q", opts, buf.String(), want)
+		}
+	}
+}
+
+func TestNotify(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	if err := d.Notify(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Notify(WithNotifyTone(440), WithNotifyDuration(2*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Notify(WithNotifyDuration(0)); err == nil {
+		t.Fatal("expected error")
+	}
+	f.set("M300", "Error: Unknown command")
+	if err := d.Notify(); err != ErrUnsupported {
+		t.Fatal(err)
+	}
+	want := []string{"M300 S1000 P500", "M300 S440 P2000", "M300 S1000 P500"}
+	if got := f.received(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestTimeRemaining(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.set("M27", "SD printing byte 0/0")
+	if _, err := d.TimeRemaining(); err == nil {
+		t.Fatal("expected error")
+	}
+	f.set("M27", "SD printing byte 10/100")
+	if _, err := d.TimeRemaining(); err == nil {
+		t.Fatal("expected error")
+	}
+	// Pretend the first sample was taken 10s ago.
+	d.statsMu.Lock()
+	d.progressSample.when = d.progressSample.when.Add(-10 * time.Second)
+	d.statsMu.Unlock()
+	f.set("M27", "SD printing byte 20/100")
+	got, err := d.TimeRemaining()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 10% per 10s, 80% to go.
+	if got < 79*time.Second || got > 81*time.Second {
+		t.Fatal(got)
+	}
+}
+
+func TestTemperatures_Celsius(t *testing.T) {
+	v := Temperatures{Extruder: celsius(210.5), Bed: celsius(60), Chamber: celsius(-5)}
+	if v.ExtruderCelsius() != 210.5 || v.BedCelsius() != 60 || v.ChamberCelsius() != -5 {
+		t.Fatalf("%g %g %g", v.ExtruderCelsius(), v.BedCelsius(), v.ChamberCelsius())
+	}
+}
+
+func TestSetLightColorFade(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	if err := d.SetLightColorFade(255, 0, 0, 1500*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	// Rounded to the nearest 100ms.
+	if err := d.SetLightColorFade(0, 255, 0, 149*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetLightColorFade(0, 0, 0, -time.Second); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := d.SetLightColorFade(0, 0, 0, 2*time.Minute); err == nil {
+		t.Fatal("expected error")
+	}
+	if want := []string{"M146 r255 g0 b0 F15", "M146 r0 g255 b0 F1"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+}
+
+func TestFactoryReset(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	if err := d.FactoryReset(nil); err == nil {
+		t.Fatal("expected error")
+	}
+	if got := f.received(); len(got) != 0 {
+		t.Fatalf("unexpected commands %q", got)
+	}
+	if err := d.FactoryReset(&ConfirmReset{}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"M502"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+}
+
+func TestParseMesh(t *testing.T) {
+	um := physic.MicroMetre
+	got, err := parseMesh("Bilinear Leveling Grid:\r\n      0      1\r\n 0 +0.010 -0.020\r\n 1 +0.030 +0.000\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]physic.Distance{{10 * um, -20 * um}, {30 * um, 0}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if _, err := parseMesh("echo:Invalid mesh."); err != ErrUnsupported {
+		t.Fatal(err)
+	}
+	if _, err := parseMesh(" 0 +0.010 -0.020\r\n 1 +0.030"); err == nil {
+		t.Fatal("expected error on ragged rows")
+	}
+	if _, err := parseMesh(" 0 +0.010 x.1"); err == nil {
+		t.Fatal("expected error on invalid value")
+	}
+}
+
+func TestBedMesh(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	f.set("M420", "Bilinear Leveling Grid:\r\n      0\r\n 0 +0.010")
+	got, err := d.BedMesh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]physic.Distance{{10 * physic.MicroMetre}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if want := []string{"M420 V"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+}
+
+func TestSplitLines(t *testing.T) {
+	data := []struct {
+		in   string
+		want []string
+	}{
+		{"", []string{}},
+		{"a", []string{"a"}},
+		{"a\r\nb\nc\rd\r\n\r\n", []string{"a", "b", "c", "d"}},
+		{"a\n\nb", []string{"a", "", "b"}},
+	}
+	for i, line := range data {
+		if got := splitLines(line.in); !reflect.DeepEqual(got, line.want) {
+			t.Fatalf("#%d: got %q, want %q", i, got, line.want)
+		}
+	}
+	// Bare "\r" line endings are accepted by the parsers.
+	s := Status{}
+	if err := parseStatus("MachineStatus: READY\rMoveMode: READY\r", &s); err != nil || s.MoveMode != "READY" {
+		t.Fatalf("%v %+v", err, s)
+	}
+	if err := parsePosition("X:0.0 Y:0.0 Z:0.0\r\n", &Position{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := parsePosition("X:0.0 Y:0.0 Z:0.0\r\nX:0.0 Y:0.0 Z:0.0", &Position{}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestWaitForState(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	f.set("M119", "MachineStatus: BUILDING_FROM_SD", "MachineStatus: BUILDING_FROM_SD", "MachineStatus: READY")
+	if err := d.WaitForState(context.Background(), MachineReady, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"M119", "M119", "M119"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := d.WaitForState(ctx, MachinePaused, time.Millisecond); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	if s := (Status{Status: "PAUSED"}); s.State() != MachinePaused {
+		t.Fatal(s.State())
+	}
+}
+
+func TestParseUptime(t *testing.T) {
+	data := []struct {
+		in   string
+		want time.Duration
+		err  bool
+	}{
+		{in: "93784", want: 93784 * time.Second},
+		{in: "1d 2h 3m 4s", want: 93784 * time.Second},
+		{in: "5m", want: 5 * time.Minute},
+		{in: "", err: true},
+		{in: "1y", err: true},
+		{in: "xh", err: true},
+	}
+	for i, line := range data {
+		got, err := parseUptime(line.in)
+		if (err != nil) != line.err {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if got != line.want {
+			t.Fatalf("#%d: got %s, want %s", i, got, line.want)
+		}
+	}
+}
+
+func TestUptime(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	if _, err := d.Uptime(); err != ErrUnsupported {
+		t.Fatal(err)
+	}
+	f.set("M115", "Machine Type: Flashforge Adventurer III\r\nUptime: 1h")
+	if got, err := d.Uptime(); err != nil || got != time.Hour {
+		t.Fatal(got, err)
+	}
+	// QueryPrinterInfo ignores it.
+	if err := d.QueryPrinterInfo(&Info{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSafeShutdown(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	if err := d.SafeShutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"M26", "M104 S0 T0", "M140 S0", "M107 P0", "M146 r0 g0 b0 F0", "M602"}
+	if got := f.received(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if err := d.QueryTemp(&Temperatures{}); err == nil {
+		t.Fatal("expected closed")
+	}
+}
+
+func TestSafeShutdown_Home(t *testing.T) {
+	f := newFakePrinter(t)
+	f.set("M114", "X:0.0 Y:0.0 Z:0.0")
+	d := f.connect()
+	f.reset()
+	if err := d.SafeShutdown(context.Background(), WithShutdownHome()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"M26", "M104 S0 T0", "M140 S0", "G28", "M114", "M107 P0", "M146 r0 g0 b0 F0", "M602"}
+	if got := f.received(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestSafeShutdown_Cancel(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// The connection is closed even if ctx is done.
+	if err := d.SafeShutdown(ctx); err == nil {
+		t.Fatal("expected error")
+	}
+	if want := []string{"M602"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+}
+
+func TestToolOffsets(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.set("M115", "Machine Type: Flashforge Adventurer III\r\nTool 1 Offset: X: 20.5 Y: 0 Z: -0.1\r\nTool 0 Offset: X:0 Y:0 Z:0")
+	i := Info{ToolOffsets: []Position{{}, {}, {}}}
+	if err := d.QueryPrinterInfo(&i); err != nil {
+		t.Fatal(err)
+	}
+	want := []Position{{}, {X: 20500 * physic.MicroMetre, Z: -100 * physic.MicroMetre}}
+	if !reflect.DeepEqual(i.ToolOffsets, want) {
+		t.Fatalf("got %+v, want %+v", i.ToolOffsets, want)
+	}
+	for _, l := range []string{"Tool 1 Offset: X: a Y: 0 Z: 0", "Tool 99 Offset: X: 0 Y: 0 Z: 0"} {
+		if err := parseToolOffset(l, &Info{}); err == nil {
+			t.Fatalf("%q: expected error", l)
+		}
+	}
+}
+
+func TestQueryPrinterInfo_Nozzle(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.set("M115", "Machine Type: Flashforge Adventurer III\r\nNozzle Diameter: 0.4mm\r\nMaterial: PLA")
+	i := Info{}
+	if err := d.QueryPrinterInfo(&i); err != nil {
+		t.Fatal(err)
+	}
+	if i.NozzleDiameter != 400*physic.MicroMetre || i.Material != "PLA" {
+		t.Fatalf("unexpected %s %q", i.NozzleDiameter, i.Material)
+	}
+	// Stale values are cleared.
+	f.set("M115", "Machine Type: Flashforge Adventurer III")
+	if err := d.QueryPrinterInfo(&i); err != nil {
+		t.Fatal(err)
+	}
+	if i.NozzleDiameter != 0 || i.Material != "" {
+		t.Fatalf("unexpected %s %q", i.NozzleDiameter, i.Material)
+	}
+	for _, l := range []string{"Nozzle Diameter: mm", "Nozzle Diameter: x"} {
+		f.set("M115", l)
+		if err := d.QueryPrinterInfo(&i); err == nil {
+			t.Fatalf("%q: expected error", l)
+		}
+	}
+}
+
+func TestNetworkInfo(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.set("M115", "Machine Type: Flashforge Adventurer III\r\nMac Address: 88:A9:A7:90:00:01\r\nIP Address: 192.168.1.20\r\nSubnet Mask: 255.255.255.0")
+	ip, mask, mac, err := d.NetworkInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.Equal(net.IPv4(192, 168, 1, 20)) || mask.String() != "ffffff00" || mac != "88:A9:A7:90:00:01" {
+		t.Fatal(ip, mask, mac)
+	}
+	// QueryPrinterInfo ignores them.
+	if err := d.QueryPrinterInfo(&Info{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range []string{"IP Address: x", "Subnet Mask: ::1"} {
+		f.set("M115", l)
+		if _, _, _, err := d.NetworkInfo(); err == nil {
+			t.Fatalf("%q: expected error", l)
+		}
+	}
+}
+
+func TestNetworkInfo_RemoteAddr(t *testing.T) {
+	listenFakePrinter(t)
+	d, err := Connect("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	// The firmware doesn't report its IP.
+	ip, mask, mac, err := d.NetworkInfo()
+	if err != nil || !ip.Equal(net.IPv4(127, 0, 0, 1)) || mask != nil || mac != "" {
+		t.Fatal(ip, mask, mac, err)
+	}
+}
+
+func TestNewDev_HelloGarbage(t *testing.T) {
+	// The first hello reply is garbage, e.g. a leftover from a previous
+	// session; it is retried once.
+	f := newFakePrinter(t)
+	f.set("M601", "Who are you?", "Control Success.")
+	d, err := NewDev(context.Background(), f.client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := f.received(); got[0] != "M601 S1" || got[1] != "M601 S1" || got[2] != "M115" {
+		t.Fatalf("unexpected commands %q", got)
+	}
+	d.Close()
+
+	// It is only retried once.
+	f = newFakePrinter(t)
+	f.set("M601", "Who are you?")
+	if _, err := NewDev(context.Background(), f.client); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+//
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(ioutil.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// celsius returns a temperature in Celsius.
+func celsius(v float64) physic.Temperature {
+	return physic.ZeroCelsius + physic.Temperature(v*float64(physic.Celsius))
+}
+
+// fakePrinter replies to the commands like an Adventurer 3 over net.Pipe.
+type fakePrinter struct {
+	t      *testing.T
+	client net.Conn
+	server net.Conn
+	// wmu serializes the writes to server.
+	wmu sync.Mutex
+	// packetDelay is the time to wait after reading each upload packet.
+	packetDelay time.Duration
+
+	mu sync.Mutex
+	// replies is the body of the reply per command, then per command code.
+	// When there are more than one, they are used in turn and the last one
+	// is kept.
+	replies map[string][]string
+	// custom replaces the reply per command code.
+	custom map[string]func(w io.Writer)
+	cmds   []string
+}
+
+func newFakePrinter(t *testing.T) *fakePrinter {
+	client, server := net.Pipe()
+	f := &fakePrinter{
+		t:       t,
+		client:  client,
+		server:  server,
+		replies: defaultReplies(),
+		custom:  map[string]func(w io.Writer){},
+	}
+	go f.serve(server)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return f
+}
+
+// listenFakePrinter returns a fake serving the first connection to the
+// printer's control port on localhost.
+func listenFakePrinter(t *testing.T) *fakePrinter {
+	l, err := net.Listen("tcp", "127.0.0.1:8899")
+	if err != nil {
+		t.Skipf("can't listen on the printer port: %s", err)
+	}
+	f := &fakePrinter{t: t, replies: defaultReplies(), custom: map[string]func(w io.Writer){}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			f.wmu.Lock()
+			f.server = conn
+			f.wmu.Unlock()
+			go func() {
+				f.serve(conn)
+				conn.Close()
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		f.drop()
+	})
+	return f
+}
+
+// drop closes the current server side connection, as if the printer
+// rebooted.
+func (f *fakePrinter) drop() {
+	f.wmu.Lock()
+	if f.server != nil {
+		f.server.Close()
+	}
+	f.wmu.Unlock()
+}
+
+// connect returns a Dev connected to the fake, as Connect does.
+func (f *fakePrinter) connect(opts ...Option) *Dev {
+	d, err := NewDev(context.Background(), f.client, opts...)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return d
+}
+
+// defaultReplies returns the replies of an idle printer.
+func defaultReplies() map[string][]string {
+	return map[string][]string{
+		"M601": {"Control Success."},
+		"M602": {"Control Release."},
+		"M105": {"T0:22 /0 B:17/0"},
+		"M115": {"Machine Type: Flashforge Adventurer III"},
+		"M119": {"MachineStatus: READY"},
+		"M23":  {"File opened: test.gcode Size: 6000\r\nFile selected"},
+		"M28":  {"Writing to file: 0:/user/test.gcode"},
+		"M29":  {"Done saving file."},
+	}
+}
+
+// set sets the bodies of the replies to cmd.
+func (f *fakePrinter) set(cmd string, bodies ...string) {
+	f.mu.Lock()
+	f.replies[cmd] = bodies
+	f.mu.Unlock()
+}
+
+// reset forgets the commands received so far.
+func (f *fakePrinter) reset() {
+	f.mu.Lock()
+	f.cmds = nil
+	f.mu.Unlock()
+}
+
+// received returns the commands received.
+func (f *fakePrinter) received() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.cmds...)
+}
+
+func (f *fakePrinter) serve(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return
+		}
+		switch b[0] {
+		case '~':
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			f.reply(conn, strings.TrimSpace(line[1:]))
+		case 0x5a:
+			// An upload packet.
+			var p [16 + packetSize]byte
+			if _, err := io.ReadFull(r, p[:]); err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.cmds = append(f.cmds, "packet")
+			f.mu.Unlock()
+			time.Sleep(f.packetDelay)
+		default:
+			r.ReadByte()
+		}
+	}
+}
+
+func (f *fakePrinter) reply(w io.Writer, cmd string) {
+	code := commandCode(cmd)
+	f.mu.Lock()
+	f.cmds = append(f.cmds, cmd)
+	if c := f.custom[code]; c != nil {
+		f.mu.Unlock()
+		f.wmu.Lock()
+		c(w)
+		f.wmu.Unlock()
+		return
+	}
+	key := cmd
+	bodies, ok := f.replies[key]
+	if !ok {
+		key = code
+		bodies = f.replies[key]
+	}
+	body := ""
+	if len(bodies) != 0 {
+		body = bodies[0]
+		if len(bodies) > 1 {
+			f.replies[key] = bodies[1:]
+		}
+	}
+	f.mu.Unlock()
+	if body != "" {
+		body += "\r\n"
+	}
+	f.wmu.Lock()
+	w.Write([]byte("CMD " + code + " Received.\r\n" + body + "ok\r\n"))
+	f.wmu.Unlock()
+}
+
+// push sends an unsolicited message, like an auto report.
+func (f *fakePrinter) push(msg string) {
+	f.wmu.Lock()
+	f.server.Write([]byte(msg))
+	f.wmu.Unlock()
+}
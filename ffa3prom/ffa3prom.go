@@ -0,0 +1,87 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+// Package ffa3prom exports the state of a FlashForge Adventurer 3 as
+// Prometheus metrics.
+//
+// It is a separate module so the ffa3 module doesn't depend on Prometheus.
+package ffa3prom
+
+import (
+	"github.com/maruel/ffa3"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector implements prometheus.Collector over a printer.
+//
+// Each collection queries the printer's temperatures and job progress. It is
+// safe to use while other commands are sent to the printer.
+type Collector struct {
+	d           *ffa3.Dev
+	temperature *prometheus.Desc
+	progress    *prometheus.Desc
+	layer       *prometheus.Desc
+	commands    *prometheus.Desc
+	errors      *prometheus.Desc
+	duration    *prometheus.Desc
+}
+
+// New returns a Collector for the printer. labels are added to all the
+// metrics, e.g. the printer name for fleets.
+func New(d *ffa3.Dev, labels prometheus.Labels) *Collector {
+	return &Collector{
+		d:           d,
+		temperature: prometheus.NewDesc("ffa3_temperature_celsius", "Current temperature.", []string{"sensor"}, labels),
+		progress:    prometheus.NewDesc("ffa3_job_progress_ratio", "Print job progress between 0 and 1.", nil, labels),
+		layer:       prometheus.NewDesc("ffa3_job_layer", "Print job current layer.", nil, labels),
+		commands:    prometheus.NewDesc("ffa3_commands_total", "Commands sent.", []string{"code"}, labels),
+		errors:      prometheus.NewDesc("ffa3_command_errors_total", "Commands that failed.", []string{"code"}, labels),
+		duration:    prometheus.NewDesc("ffa3_command_duration_seconds_total", "Total round trip time of the commands.", []string{"code"}, labels),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.temperature
+	ch <- c.progress
+	ch <- c.layer
+	ch <- c.commands
+	ch <- c.errors
+	ch <- c.duration
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	t := ffa3.Temperatures{}
+	if err := c.d.QueryTemp(&t); err != nil {
+		ch <- prometheus.NewInvalidMetric(c.temperature, err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(c.temperature, prometheus.GaugeValue, t.Extruder.Celsius(), "extruder")
+		// Zero means the printer didn't report it.
+		if t.Bed != 0 {
+			ch <- prometheus.MustNewConstMetric(c.temperature, prometheus.GaugeValue, t.Bed.Celsius(), "bed")
+		}
+		if t.Chamber != 0 {
+			ch <- prometheus.MustNewConstMetric(c.temperature, prometheus.GaugeValue, t.Chamber.Celsius(), "chamber")
+		}
+	}
+
+	j := ffa3.Job{}
+	if err := c.d.QueryJobStatus(&j); err != nil {
+		ch <- prometheus.NewInvalidMetric(c.progress, err)
+	} else {
+		p := 0.
+		if j.Total != 0 {
+			p = float64(j.Printed) / float64(j.Total)
+		}
+		ch <- prometheus.MustNewConstMetric(c.progress, prometheus.GaugeValue, p)
+		ch <- prometheus.MustNewConstMetric(c.layer, prometheus.GaugeValue, float64(j.Layer))
+	}
+
+	for code, s := range c.d.Stats().PerCommand {
+		ch <- prometheus.MustNewConstMetric(c.commands, prometheus.CounterValue, float64(s.Count), code)
+		ch <- prometheus.MustNewConstMetric(c.errors, prometheus.CounterValue, float64(s.Errors), code)
+		ch <- prometheus.MustNewConstMetric(c.duration, prometheus.CounterValue, s.Total.Seconds(), code)
+	}
+}
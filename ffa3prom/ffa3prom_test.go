@@ -0,0 +1,81 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package ffa3prom
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/maruel/ffa3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollector(t *testing.T) {
+	d := newFakeDev(t, map[string]string{
+		"M105": "T0:210 /210 B:60/60",
+		"M27":  "SD printing byte 25/100\r\nLayer: 3/20",
+	})
+	c := New(d, map[string]string{"printer": "shop"})
+	want := `
+# HELP ffa3_job_layer Print job current layer.
+# TYPE ffa3_job_layer gauge
+ffa3_job_layer{printer="shop"} 3
+# HELP ffa3_job_progress_ratio Print job progress between 0 and 1.
+# TYPE ffa3_job_progress_ratio gauge
+ffa3_job_progress_ratio{printer="shop"} 0.25
+# HELP ffa3_temperature_celsius Current temperature.
+# TYPE ffa3_temperature_celsius gauge
+ffa3_temperature_celsius{printer="shop",sensor="bed"} 60
+ffa3_temperature_celsius{printer="shop",sensor="extruder"} 210
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(want), "ffa3_temperature_celsius", "ffa3_job_progress_ratio", "ffa3_job_layer"); err != nil {
+		t.Fatal(err)
+	}
+	// The command statistics are exported too.
+	if n := testutil.CollectAndCount(c, "ffa3_commands_total"); n == 0 {
+		t.Fatal("no command metric")
+	}
+}
+
+//
+
+// newFakeDev returns a Dev connected to a fake printer replying with the
+// bodies in replies, by command code.
+func newFakeDev(t *testing.T, replies map[string]string) *ffa3.Dev {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	go func() {
+		r := bufio.NewReader(server)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			code := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(line, "~")), " ", 2)[0]
+			body := replies[code]
+			switch code {
+			case "M601":
+				body = "Control Success."
+			case "M602":
+				body = "Control Release."
+			}
+			if body != "" {
+				body += "\r\n"
+			}
+			server.Write([]byte("CMD " + code + " Received.\r\n" + body + "ok\r\n"))
+		}
+	}()
+	d, err := ffa3.NewDev(context.Background(), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
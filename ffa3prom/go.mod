@@ -0,0 +1,10 @@
+module github.com/maruel/ffa3/ffa3prom
+
+go 1.15
+
+require (
+	github.com/maruel/ffa3 v0.0.0-20261014162519-e2d257fcade7
+	github.com/prometheus/client_golang v1.11.0
+)
+
+replace github.com/maruel/ffa3 => ../
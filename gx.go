@@ -0,0 +1,110 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package ffa3
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+)
+
+// ErrNoThumbnail is returned by ExtractGXThumbnail when the .gx file doesn't
+// embed a preview.
+var ErrNoThumbnail = errors.New(".gx file has no thumbnail")
+
+// ExtractGXThumbnail decodes the preview bitmap embedded in a .gx file.
+//
+// Only the header and the bitmap are read from r.
+func ExtractGXThumbnail(r io.Reader) (image.Image, error) {
+	// The header is 58 bytes:
+	//   0x00: "xgcode 1.0\n" zero padded to 16 bytes
+	//   0x10: uint32 0
+	//   0x14: uint32 bitmap offset
+	//   0x18: uint32 G-code offset
+	//   0x1C: uint32 G-code offset, again
+	//   0x20: print settings (time, filament, temperatures, etc)
+	var hdr [58]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("failed to read .gx header: %w", err)
+	}
+	if string(hdr[:len(gxMagic)]) != gxMagic {
+		return nil, errors.New("not a .gx file")
+	}
+	bmpStart := binary.LittleEndian.Uint32(hdr[0x14:])
+	gcodeStart := binary.LittleEndian.Uint32(hdr[0x18:])
+	if bmpStart < uint32(len(hdr)) || gcodeStart < bmpStart {
+		return nil, fmt.Errorf("invalid .gx header offsets %d and %d", bmpStart, gcodeStart)
+	}
+	if gcodeStart == bmpStart {
+		return nil, ErrNoThumbnail
+	}
+	if gcodeStart-bmpStart > maxThumbnailSize {
+		return nil, fmt.Errorf("invalid .gx thumbnail: %d bytes is too large", gcodeStart-bmpStart)
+	}
+	if _, err := io.CopyN(ioutil.Discard, r, int64(bmpStart)-int64(len(hdr))); err != nil {
+		return nil, fmt.Errorf("failed to read .gx header: %w", err)
+	}
+	b := make([]byte, gcodeStart-bmpStart)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, fmt.Errorf("failed to read .gx thumbnail: %w", err)
+	}
+	return decodeBMP(b)
+}
+
+// Internal
+
+const (
+	// maxThumbnailSize is the largest embedded bitmap accepted, in bytes. The
+	// slicers embed a small preview, so anything larger is a corrupted header.
+	maxThumbnailSize = 4 << 20
+	// maxThumbnailDim is the largest bitmap width or height accepted.
+	maxThumbnailDim = 4096
+)
+
+// decodeBMP decodes an uncompressed 24 or 32 bits BMP file.
+func decodeBMP(b []byte) (image.Image, error) {
+	if len(b) < 54 || b[0] != 'B' || b[1] != 'M' {
+		return nil, errors.New("invalid .gx thumbnail: not a BMP")
+	}
+	offset := int(binary.LittleEndian.Uint32(b[10:]))
+	w := int(int32(binary.LittleEndian.Uint32(b[18:])))
+	h := int(int32(binary.LittleEndian.Uint32(b[22:])))
+	bpp := int(binary.LittleEndian.Uint16(b[28:]))
+	if c := binary.LittleEndian.Uint32(b[30:]); c != 0 && c != 3 {
+		return nil, fmt.Errorf("invalid .gx thumbnail: unsupported compression %d", c)
+	}
+	if bpp != 24 && bpp != 32 {
+		return nil, fmt.Errorf("invalid .gx thumbnail: unsupported %d bits per pixel", bpp)
+	}
+	// Rows are stored bottom-up unless the height is negative.
+	topDown := h < 0
+	if topDown {
+		h = -h
+	}
+	if w <= 0 || h == 0 || w > maxThumbnailDim || h > maxThumbnailDim {
+		return nil, fmt.Errorf("invalid .gx thumbnail: size %dx%d", w, h)
+	}
+	stride := (int64(w)*int64(bpp)/8 + 3) &^ 3
+	if offset < 0 || int64(offset)+stride*int64(h) > int64(len(b)) {
+		return nil, errors.New("invalid .gx thumbnail: truncated")
+	}
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		row := b[offset+int(stride)*y:]
+		dy := y
+		if !topDown {
+			dy = h - 1 - y
+		}
+		for x := 0; x < w; x++ {
+			p := row[x*bpp/8:]
+			img.SetRGBA(x, dy, color.RGBA{R: p[2], G: p[1], B: p[0], A: 255})
+		}
+	}
+	return img, nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package ffa3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/color"
+	"testing"
+)
+
+func TestExtractGXThumbnail(t *testing.T) {
+	bmp := makeBMP(2, 2, 24)
+	// Bottom-up: the first row is the bottom one.
+	copy(bmp[54:], []byte{1, 2, 3, 4, 5, 6, 0, 0, 7, 8, 9, 10, 11, 12, 0, 0})
+	img, err := ExtractGXThumbnail(bytes.NewReader(append(makeGX(58, 58+uint32(len(bmp))), bmp...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 2 || b.Dy() != 2 {
+		t.Fatal(b)
+	}
+	if got, want := img.At(0, 1), (color.RGBA{R: 3, G: 2, B: 1, A: 255}); got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := img.At(1, 0), (color.RGBA{R: 12, G: 11, B: 10, A: 255}); got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestExtractGXThumbnail_Invalid(t *testing.T) {
+	data := []struct {
+		name string
+		in   []byte
+	}{
+		{"short", []byte(gxMagic)},
+		{"magic", make([]byte, 58)},
+		{"offsets", makeGX(100, 90)},
+		{"bmp in header", makeGX(10, 100)},
+		{"truncated", makeGX(58, 1000)},
+		// Rejected before reading, let alone allocating, the bitmap.
+		{"huge", makeGX(58, 0xFFFFFFF0)},
+	}
+	for _, line := range data {
+		if _, err := ExtractGXThumbnail(bytes.NewReader(line.in)); err == nil {
+			t.Fatalf("%s: expected error", line.name)
+		}
+	}
+	if _, err := ExtractGXThumbnail(bytes.NewReader(makeGX(58, 58))); err != ErrNoThumbnail {
+		t.Fatal(err)
+	}
+}
+
+func TestDecodeBMP_Invalid(t *testing.T) {
+	negative := makeBMP(2, 2, 24)
+	binary.LittleEndian.PutUint32(negative[18:], 0xFFFFFFFE)
+	offset := makeBMP(2, 2, 24)
+	binary.LittleEndian.PutUint32(offset[10:], 0xFFFFFFF0)
+	compressed := makeBMP(2, 2, 24)
+	binary.LittleEndian.PutUint32(compressed[30:], 1)
+	truncated := makeBMP(2, 2, 32)
+	binary.LittleEndian.PutUint32(truncated[18:], 100)
+	huge := makeBMP(2, 2, 32)
+	binary.LittleEndian.PutUint32(huge[18:], 0x7FFFFFFF)
+	binary.LittleEndian.PutUint32(huge[22:], 0x7FFFFFFF)
+	tall := makeBMP(2, 2, 24)
+	binary.LittleEndian.PutUint32(tall[22:], maxThumbnailDim+1)
+	data := []struct {
+		name string
+		in   []byte
+	}{
+		{"short", []byte("BM")},
+		{"magic", make([]byte, 70)},
+		{"bpp", makeBMP(2, 2, 8)},
+		{"truncated", truncated},
+		{"negative width", negative},
+		{"huge", huge},
+		{"tall", tall},
+		{"offset", offset},
+		{"compressed", compressed},
+	}
+	for _, line := range data {
+		if _, err := decodeBMP(line.in); err == nil {
+			t.Fatalf("%s: expected error", line.name)
+		}
+	}
+}
+
+func TestDecodeBMP_TopDown(t *testing.T) {
+	b := makeBMP(1, 2, 32)
+	binary.LittleEndian.PutUint32(b[22:], 0xFFFFFFFE)
+	copy(b[54:], []byte{1, 2, 3, 0, 4, 5, 6, 0})
+	img, err := decodeBMP(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := img.At(0, 0), (color.RGBA{R: 3, G: 2, B: 1, A: 255}); got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+//
+
+// makeGX returns a .gx header with the bitmap and G-code offsets.
+func makeGX(bmpStart, gcodeStart uint32) []byte {
+	b := make([]byte, 58)
+	copy(b, gxMagic)
+	binary.LittleEndian.PutUint32(b[0x14:], bmpStart)
+	binary.LittleEndian.PutUint32(b[0x18:], gcodeStart)
+	binary.LittleEndian.PutUint32(b[0x1C:], gcodeStart)
+	return b
+}
+
+// makeBMP returns a zeroed uncompressed BMP.
+func makeBMP(w, h, bpp int) []byte {
+	stride := (w*bpp/8 + 3) &^ 3
+	b := make([]byte, 54+stride*h)
+	b[0], b[1] = 'B', 'M'
+	binary.LittleEndian.PutUint32(b[2:], uint32(len(b)))
+	binary.LittleEndian.PutUint32(b[10:], 54)
+	binary.LittleEndian.PutUint32(b[14:], 40)
+	binary.LittleEndian.PutUint32(b[18:], uint32(w))
+	binary.LittleEndian.PutUint32(b[22:], uint32(h))
+	binary.LittleEndian.PutUint16(b[26:], 1)
+	binary.LittleEndian.PutUint16(b[28:], uint16(bpp))
+	return b
+}
@@ -0,0 +1,96 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package ffa3
+
+import (
+	"strconv"
+	"strings"
+
+	"periph.io/x/conn/v3/physic"
+)
+
+// Supports returns true if the printer is known to support the command, e.g.
+// "M141" or "M141 S40".
+func (c Capabilities) Supports(cmd string) bool {
+	return c.commands[strings.ToUpper(commandCode(cmd))]
+}
+
+// Internal
+
+// baseCommands are the commands supported by all the known firmware.
+var baseCommands = []string{
+	"G1", "G28", "G90", "G91",
+	"M23", "M24", "M25", "M26", "M27", "M28", "M29", "M82", "M83",
+	"M104", "M105", "M106", "M107", "M110", "M112", "M114", "M115", "M119",
+	"M146", "M220", "M221", "M601", "M602", "M610",
+}
+
+// detectCommands sets the commands supported in c from the probed
+// capabilities.
+func detectCommands(c *Capabilities) {
+	c.commands = map[string]bool{}
+	for _, cmd := range baseCommands {
+		c.commands[cmd] = true
+	}
+	if c.HasHeatedBed {
+		c.commands["M140"] = true
+	}
+	if c.HasChamber {
+		c.commands["M141"] = true
+	}
+	if c.HasQueue && experimentalQueue {
+		c.commands[queueListCmd] = true
+		c.commands[queueCancelCmd] = true
+	}
+}
+
+// model is a known printer model.
+type model struct {
+	name string
+	// match are the lowercase substrings of Info.Type identifying the model.
+	match   []string
+	x, y, z physic.Distance
+}
+
+// models is ordered so the most specific matches come first.
+var models = []model{
+	{"Adventurer 3 Pro", []string{"adventurer 3 pro", "adventurer iii pro"}, 150 * physic.MilliMetre, 150 * physic.MilliMetre, 150 * physic.MilliMetre},
+	{"Adventurer 3 Lite", []string{"adventurer 3 lite", "adventurer iii lite"}, 150 * physic.MilliMetre, 150 * physic.MilliMetre, 150 * physic.MilliMetre},
+	{"Adventurer 3", []string{"adventurer 3", "adventurer iii"}, 150 * physic.MilliMetre, 150 * physic.MilliMetre, 150 * physic.MilliMetre},
+	{"Adventurer 4", []string{"adventurer 4", "adventurer iv"}, 220 * physic.MilliMetre, 200 * physic.MilliMetre, 250 * physic.MilliMetre},
+}
+
+// detectModel sets the model and build volume in c from the printer
+// information.
+//
+// It uses the dimensions reported by M115 when the model is unknown.
+func detectModel(i *Info, c *Capabilities) {
+	c.Model = ""
+	c.BuildX, c.BuildY, c.BuildZ = i.X, i.Y, i.Z
+	t := strings.ToLower(i.Type)
+	for _, m := range models {
+		for _, s := range m.match {
+			if strings.Contains(t, s) {
+				c.Model = m.name
+				c.BuildX, c.BuildY, c.BuildZ = m.x, m.y, m.z
+				return
+			}
+		}
+	}
+}
+
+// lightUppercase returns true if the firmware expects the M146 color channels
+// in uppercase, e.g. "M146 R255 G255 B255".
+//
+// Firmware 1.x, e.g. "v1.3.7", only accepts lowercase channels. Later major
+// versions expect uppercase. Unparsable versions keep the lowercase default.
+func lightUppercase(firmware string) bool {
+	v := strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(firmware), "V"), "v")
+	if i := strings.IndexByte(v, '.'); i != -1 {
+		v = v[:i]
+	}
+	major, err := strconv.Atoi(v)
+	return err == nil && major >= 2
+}
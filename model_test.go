@@ -0,0 +1,89 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package ffa3
+
+import (
+	"reflect"
+	"testing"
+
+	"periph.io/x/conn/v3/physic"
+)
+
+func TestDetectModel(t *testing.T) {
+	mm := physic.MilliMetre
+	data := []struct {
+		typ     string
+		x, y, z physic.Distance
+		model   string
+		wantX   physic.Distance
+		wantZ   physic.Distance
+	}{
+		{"Flashforge Adventurer III", 0, 0, 0, "Adventurer 3", 150 * mm, 150 * mm},
+		{"FlashForge Adventurer 3 Pro", 0, 0, 0, "Adventurer 3 Pro", 150 * mm, 150 * mm},
+		{"Adventurer III Lite", 0, 0, 0, "Adventurer 3 Lite", 150 * mm, 150 * mm},
+		{"FlashForge Adventurer 4", 0, 0, 0, "Adventurer 4", 220 * mm, 250 * mm},
+		{"Something else", 100 * mm, 110 * mm, 120 * mm, "", 100 * mm, 120 * mm},
+		{"", 0, 0, 0, "", 0, 0},
+	}
+	for i, line := range data {
+		c := Capabilities{Model: "stale"}
+		detectModel(&Info{Type: line.typ, X: line.x, Y: line.y, Z: line.z}, &c)
+		if c.Model != line.model || c.BuildX != line.wantX || c.BuildZ != line.wantZ {
+			t.Fatalf("#%d: got %q %s %s", i, c.Model, c.BuildX, c.BuildZ)
+		}
+	}
+}
+
+func TestMoveTo_Volume(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	mm := physic.MilliMetre
+	if err := d.MoveTo(0, 0, 151*mm, 50*physic.MilliMetrePerSecond); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := d.MoveTo(-151*mm, 0, 0, 50*physic.MilliMetrePerSecond); err == nil {
+		t.Fatal("expected error")
+	}
+	if got := f.received(); len(got) != 0 {
+		t.Fatalf("unexpected commands %q", got)
+	}
+	if err := d.MoveTo(-75*mm, 75*mm, 150*mm, 50*physic.MilliMetrePerSecond); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLightUppercase(t *testing.T) {
+	data := []struct {
+		in   string
+		want bool
+	}{
+		{"v1.3.7", false},
+		{"V1.9", false},
+		{"v2.0.1", true},
+		{" 3.1 ", true},
+		{"2", true},
+		{"", false},
+		{"beta", false},
+	}
+	for i, line := range data {
+		if got := lightUppercase(line.in); got != line.want {
+			t.Fatalf("#%d: got %t, want %t", i, got, line.want)
+		}
+	}
+}
+
+func TestSetLightColor_Uppercase(t *testing.T) {
+	f := newFakePrinter(t)
+	f.set("M115", "Machine Type: Flashforge Adventurer III\r\nFirmware: v2.1.0")
+	d := f.connect()
+	f.reset()
+	if err := d.SetLightColor(255, 128, 0); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"M146 R255 G128 B0 F0"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+}
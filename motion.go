@@ -0,0 +1,151 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package ffa3
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"periph.io/x/conn/v3/physic"
+)
+
+// Motion is the motion settings of the printer, as reported by M503.
+//
+// A zero value means the firmware didn't report it.
+type Motion struct {
+	// MaxAccelX, MaxAccelY, MaxAccelZ and MaxAccelE are the maximum
+	// accelerations per axis in mm/s², as set by M201.
+	MaxAccelX float64
+	MaxAccelY float64
+	MaxAccelZ float64
+	MaxAccelE float64
+	// JerkX, JerkY, JerkZ and JerkE are the maximum instantaneous speed
+	// changes per axis, as set by M205.
+	JerkX physic.Speed
+	JerkY physic.Speed
+	JerkZ physic.Speed
+	JerkE physic.Speed
+	_     struct{}
+}
+
+// QueryMotion returns the acceleration and jerk settings.
+//
+// It returns ErrUnsupported if the firmware doesn't report them.
+func (d *Dev) QueryMotion(m *Motion) error {
+	resp, err := d.sendQuery("M503")
+	if err != nil {
+		var ferr *FirmwareError
+		if errors.As(err, &ferr) {
+			return ErrUnsupported
+		}
+		return err
+	}
+	return parseMotion(resp, m)
+}
+
+// SetAcceleration sets the maximum accelerations per axis in mm/s².
+//
+// Only the non-zero values are sent. It returns ErrUnsupported if the firmware
+// rejects M201.
+func (d *Dev) SetAcceleration(x, y, z, e float64) error {
+	return d.setMotion("M201", formatAxes(x, y, z, e))
+}
+
+// SetJerk sets the maximum instantaneous speed changes per axis.
+//
+// Only the non-zero values are sent. It returns ErrUnsupported if the firmware
+// rejects M205.
+func (d *Dev) SetJerk(x, y, z, e physic.Speed) error {
+	return d.setMotion("M205", formatAxes(speedToMMPerS(x), speedToMMPerS(y), speedToMMPerS(z), speedToMMPerS(e)))
+}
+
+// Internal
+
+// setMotion sends a motion settings command.
+func (d *Dev) setMotion(code string, args []string) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return errors.New("no value to set")
+	}
+	resp, err := d.sendCommand(formatCmd(code, args...))
+	var ferr *FirmwareError
+	if errors.As(err, &ferr) {
+		return ErrUnsupported
+	}
+	if resp != "" {
+		return fmt.Errorf("unknown reply: %q", resp)
+	}
+	return err
+}
+
+// formatAxes returns the arguments for the non-zero axes values.
+func formatAxes(x, y, z, e float64) []string {
+	var out []string
+	for i, v := range []float64{x, y, z, e} {
+		if v != 0 {
+			out = append(out, string("XYZE"[i])+strconv.FormatFloat(v, 'f', -1, 64))
+		}
+	}
+	return out
+}
+
+// speedToMMPerS converts a speed to the mm/s M205 expects.
+func speedToMMPerS(s physic.Speed) float64 {
+	return float64(s) / float64(physic.MilliMetrePerSecond)
+}
+
+// parseMotion parses the M201 and M205 lines of a M503 reply, e.g.:
+//
+//	echo:  M201 X1000.00 Y1000.00 Z100.00 E5000.00
+//	echo:  M205 X10.00 Y10.00 Z0.30 E5.00
+func parseMotion(resp string, m *Motion) error {
+	*m = Motion{}
+	found := false
+	for _, line := range splitLines(resp) {
+		f := strings.Fields(strings.TrimPrefix(line, "echo:"))
+		if len(f) == 0 || (f[0] != "M201" && f[0] != "M205") {
+			continue
+		}
+		found = true
+		for _, a := range f[1:] {
+			v, err := strconv.ParseFloat(a[1:], 64)
+			if err != nil {
+				return fmt.Errorf("unknown reply: %q", line)
+			}
+			if f[0] == "M201" {
+				switch a[0] {
+				case 'X':
+					m.MaxAccelX = v
+				case 'Y':
+					m.MaxAccelY = v
+				case 'Z':
+					m.MaxAccelZ = v
+				case 'E':
+					m.MaxAccelE = v
+				}
+				continue
+			}
+			s := physic.Speed(v * float64(physic.MilliMetrePerSecond))
+			switch a[0] {
+			case 'X':
+				m.JerkX = s
+			case 'Y':
+				m.JerkY = s
+			case 'Z':
+				m.JerkZ = s
+			case 'E':
+				m.JerkE = s
+			}
+		}
+	}
+	if !found {
+		return ErrUnsupported
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package ffa3
+
+import (
+	"reflect"
+	"testing"
+
+	"periph.io/x/conn/v3/physic"
+)
+
+func TestParseMotion(t *testing.T) {
+	mmps := physic.MilliMetrePerSecond
+	data := []struct {
+		in   string
+		want Motion
+		err  error
+	}{
+		{
+			in: "echo:  M201 X1000.00 Y1000.00 Z100.00 E5000.00\r\necho:  M205 X10.00 Y10.00 Z0.30 E5.00",
+			want: Motion{
+				MaxAccelX: 1000, MaxAccelY: 1000, MaxAccelZ: 100, MaxAccelE: 5000,
+				JerkX: 10 * mmps, JerkY: 10 * mmps, JerkZ: 300 * physic.MicroMetrePerSecond, JerkE: 5 * mmps,
+			},
+		},
+		{in: "M201 X500", want: Motion{MaxAccelX: 500}},
+		{in: "echo: Steps per unit:\r\nM92 X80", err: ErrUnsupported},
+	}
+	for i, line := range data {
+		got := Motion{MaxAccelY: 1}
+		if err := parseMotion(line.in, &got); err != line.err {
+			t.Fatalf("#%d: unexpected error %v", i, err)
+		}
+		if line.err == nil && got != line.want {
+			t.Fatalf("#%d: got %+v, want %+v", i, got, line.want)
+		}
+	}
+	if err := parseMotion("M205 Xa", &Motion{}); err == nil || err == ErrUnsupported {
+		t.Fatal(err)
+	}
+}
+
+func TestQueryMotion(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.set("M503", "Error: Unknown command")
+	if err := d.QueryMotion(&Motion{}); err != ErrUnsupported {
+		t.Fatal(err)
+	}
+	f.set("M503", "M201 X500")
+	m := Motion{}
+	if err := d.QueryMotion(&m); err != nil || m.MaxAccelX != 500 {
+		t.Fatal(m, err)
+	}
+}
+
+func TestSetAcceleration(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	if err := d.SetAcceleration(1000, 0, 100.5, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetJerk(10*physic.MilliMetrePerSecond, 0, 0, 5*physic.MilliMetrePerSecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetAcceleration(0, 0, 0, 0); err == nil {
+		t.Fatal("expected error")
+	}
+	f.set("M205", "Error: Unknown command")
+	if err := d.SetJerk(physic.MilliMetrePerSecond, 0, 0, 0); err != ErrUnsupported {
+		t.Fatal(err)
+	}
+	want := []string{"M201 X1000 Z100.5", "M205 X10 E5", "M205 X1"}
+	if got := f.received(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package ffa3
+
+import (
+	"context"
+	"fmt"
+
+	"periph.io/x/conn/v3/physic"
+)
+
+// PrepBuilder accumulates print preparation steps to run in order.
+//
+// Create one with Dev.Prepare, e.g.:
+//
+//	err := d.Prepare().Home().HeatExtruder(t).HeatBed(b).Run(ctx)
+type PrepBuilder struct {
+	d          *Dev
+	steps      []prepStep
+	onProgress func(step string, i, n int)
+}
+
+// Prepare returns a PrepBuilder.
+func (d *Dev) Prepare() *PrepBuilder {
+	return &PrepBuilder{d: d}
+}
+
+// Home adds a step homing all axes.
+func (p *PrepBuilder) Home() *PrepBuilder {
+	return p.add("home", func(ctx context.Context) error {
+		_, err := p.d.AutoHome(ctx)
+		return err
+	})
+}
+
+// HeatExtruder adds a step heating the extruder and waiting for t.
+func (p *PrepBuilder) HeatExtruder(t physic.Temperature) *PrepBuilder {
+	return p.add("heat extruder to "+t.String(), func(ctx context.Context) error {
+		return p.d.HeatExtruderAndWait(ctx, t)
+	})
+}
+
+// HeatBed adds a step heating the bed and waiting for t.
+func (p *PrepBuilder) HeatBed(t physic.Temperature) *PrepBuilder {
+	return p.add("heat bed to "+t.String(), func(ctx context.Context) error {
+		return p.d.HeatBedAndWait(ctx, t)
+	})
+}
+
+// MoveTo adds a step moving the extruder to the absolute position at speed.
+func (p *PrepBuilder) MoveTo(x, y, z physic.Distance, speed physic.Speed) *PrepBuilder {
+	return p.add(fmt.Sprintf("move to %s,%s,%s", x, y, z), func(ctx context.Context) error {
+		return p.d.MoveTo(x, y, z, speed)
+	})
+}
+
+// Prime adds a step priming the nozzle, see Dev.Prime.
+func (p *PrepBuilder) Prime(opts ...PrimeOption) *PrepBuilder {
+	return p.add("prime", func(ctx context.Context) error {
+		return p.d.Prime(ctx, opts...)
+	})
+}
+
+// OnProgress sets a function called before each step is run.
+func (p *PrepBuilder) OnProgress(f func(step string, i, n int)) *PrepBuilder {
+	p.onProgress = f
+	return p
+}
+
+// Run runs the steps in the order they were added.
+//
+// It stops at the first step failing and returns its error, prefixed with the
+// step name.
+func (p *PrepBuilder) Run(ctx context.Context) error {
+	for i, s := range p.steps {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if p.onProgress != nil {
+			p.onProgress(s.name, i, len(p.steps))
+		}
+		if err := s.run(ctx); err != nil {
+			return fmt.Errorf("%s: %w", s.name, err)
+		}
+	}
+	return nil
+}
+
+// Internal
+
+// prepStep is a step of a PrepBuilder.
+type prepStep struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+func (p *PrepBuilder) add(name string, run func(ctx context.Context) error) *PrepBuilder {
+	p.steps = append(p.steps, prepStep{name: name, run: run})
+	return p
+}
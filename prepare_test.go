@@ -0,0 +1,58 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package ffa3
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"periph.io/x/conn/v3/physic"
+)
+
+func TestPrepare(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	f.set("M114", "X:0.0 Y:0.0 Z:0.0")
+	f.set("M105", "T0:200 /200 B:60/60")
+	var steps []string
+	err := d.Prepare().Home().HeatBed(celsius(60)).HeatExtruder(celsius(200)).MoveTo(0, 0, physic.MilliMetre, 50*physic.MilliMetrePerSecond).OnProgress(func(step string, i, n int) {
+		if n != 4 {
+			t.Errorf("unexpected n %d", n)
+		}
+		steps = append(steps, step)
+	}).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"home", "heat bed to 60°C", "heat extruder to 200°C", "move to 0m,0m,1mm"}; !reflect.DeepEqual(steps, want) {
+		t.Fatalf("got %q, want %q", steps, want)
+	}
+	want := []string{"G28", "M114", "M140 S60", "M105", "M104 S200 T0", "M105", "G90", "G1 X0 Y0 Z1 F3000"}
+	if got := f.received(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestPrepare_Error(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	// The first failing step stops the run.
+	err := d.Prepare().HeatExtruder(celsius(400)).Home().Run(context.Background())
+	if err == nil || !strings.HasPrefix(err.Error(), "heat extruder to 400°C: ") {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := d.Prepare().Home().Run(ctx); err != context.Canceled {
+		t.Fatal(err)
+	}
+	if got := f.received(); len(got) != 0 {
+		t.Fatalf("unexpected commands %q", got)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package ffa3
+
+import (
+	"context"
+	"fmt"
+
+	"periph.io/x/conn/v3/physic"
+)
+
+// PrimeOption is an option to Prime.
+type PrimeOption func(o *primeOptions)
+
+// WithPrimeTemperature sets the nozzle temperature to prime at. It defaults
+// to 210°C.
+func WithPrimeTemperature(t physic.Temperature) PrimeOption {
+	return func(o *primeOptions) {
+		o.temp = t
+	}
+}
+
+// WithPrimeLength sets the length of the priming line drawn along the X axis.
+// It defaults to 60mm.
+func WithPrimeLength(l physic.Distance) PrimeOption {
+	return func(o *primeOptions) {
+		o.length = l
+	}
+}
+
+// Prime primes the nozzle before a print: it homes, moves to the front left
+// corner, heats the nozzle and extrudes a short line on the bed.
+//
+// The nozzle is left hot. It refuses to extrude below minExtrudeTemp.
+func (d *Dev) Prime(ctx context.Context, opts ...PrimeOption) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	o := primeOptions{temp: primeTemp, length: primeLength}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.temp < minExtrudeTemp {
+		return fmt.Errorf("prime temperature %s is below the minimum extrusion temperature %s", o.temp, minExtrudeTemp)
+	}
+	if o.length <= 0 {
+		return fmt.Errorf("invalid prime length %s", o.length)
+	}
+	if _, err := d.AutoHome(ctx); err != nil {
+		return err
+	}
+	// The origin is at the bed center.
+	x, y := -d.caps.BuildX/2+primeMargin, -d.caps.BuildY/2+primeMargin
+	if d.caps.BuildX == 0 || d.caps.BuildY == 0 {
+		x, y = 0, 0
+	}
+	if err := d.MoveTo(x, y, primeHeight, primeTravelSpeed); err != nil {
+		return err
+	}
+	if err := d.HeatExtruderAndWait(ctx, o.temp); err != nil {
+		return err
+	}
+	t := Temperatures{}
+	if err := d.QueryTemp(&t); err != nil {
+		return err
+	}
+	if t.Extruder < minExtrudeTemp {
+		return fmt.Errorf("refusing to extrude: nozzle is at %s, below %s", t.Extruder, minExtrudeTemp)
+	}
+	return d.primeLine(ctx, o.length)
+}
+
+// Internal
+
+const (
+	// minExtrudeTemp is the lowest nozzle temperature Prime extrudes at.
+	minExtrudeTemp = physic.ZeroCelsius + 170*physic.Celsius
+	// primeTemp and primeLength are the Prime defaults.
+	primeTemp   = physic.ZeroCelsius + 210*physic.Celsius
+	primeLength = 60 * physic.MilliMetre
+	// primeMargin is the distance from the bed edges of the priming line.
+	primeMargin = 5 * physic.MilliMetre
+	// primeHeight is the nozzle height while priming.
+	primeHeight = 300 * physic.MicroMetre
+	// primeFilament is the filament extruded per length of priming line.
+	primeFilament = 0.05
+	// primeTravelSpeed and primeSpeed are the speeds moving to the corner and
+	// drawing the line.
+	primeTravelSpeed = 50 * physic.MilliMetrePerSecond
+	primeSpeed       = 20 * physic.MilliMetrePerSecond
+)
+
+type primeOptions struct {
+	temp   physic.Temperature
+	length physic.Distance
+}
+
+// primeLine draws a line of length along the X axis while extruding.
+//
+// The previous positioning and extrusion modes are restored afterward, if
+// they were known.
+func (d *Dev) primeLine(ctx context.Context, length physic.Distance) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	prevPos, prevExt := d.positioning, d.extrusion
+	if err := d.setPositioningMode(ctx, false); err != nil {
+		return err
+	}
+	e := physic.Distance(float64(length) * primeFilament)
+	resp, err := d.send(ctx, formatCmd("G1", "X"+formatMM(length), "E"+formatMM(e), fmt.Sprintf("F%d", speedToMMPerMin(primeSpeed))))
+	if resp != "" && err == nil {
+		err = fmt.Errorf("unknown reply: %q", resp)
+	}
+	if prevPos == modeAbsolute {
+		if err2 := d.setPositioningMode(ctx, true); err == nil {
+			err = err2
+		}
+	}
+	if prevExt != d.extrusion && prevExt != modeUnknown {
+		if err2 := d.setExtrusionMode(ctx, prevExt == modeRelative); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
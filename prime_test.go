@@ -0,0 +1,44 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package ffa3
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestPrime(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	f.set("M114", "X:0.0 Y:0.0 Z:0.0")
+	f.set("M105", "T0:210 /210 B:17/0")
+	if err := d.Prime(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"G28", "M114", "G90", "G1 X-70 Y-70 Z0.3 F3000", "M104 S210 T0", "M105", "M105",
+		"G91", "G1 X60 E3 F1200", "G90",
+	}
+	if got := f.received(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestPrime_Invalid(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	if err := d.Prime(context.Background(), WithPrimeTemperature(celsius(150))); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := d.Prime(context.Background(), WithPrimeLength(0)); err == nil {
+		t.Fatal("expected error")
+	}
+	if got := f.received(); len(got) != 0 {
+		t.Fatalf("unexpected commands %q", got)
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package ffa3
+
+import (
+	"context"
+	"io"
+	"log"
+	"strings"
+)
+
+// WithReadPump makes Dev read the connection in a background goroutine.
+//
+// The pump routes the replies to the waiting command and the messages the
+// printer sends on its own, like the M27 auto reports, to Pushes. Without it,
+// Dev strictly reads one reply per command sent.
+func WithReadPump() Option {
+	return func(o *options) {
+		o.readPump = true
+	}
+}
+
+// Pushes returns the messages the printer sent on its own.
+//
+// It is only available with WithReadPump, otherwise it returns nil. The
+// channel is closed once the connection is closed. Messages are dropped when
+// the channel is not drained. SubscribeJobStatus consumes from this channel
+// too.
+func (d *Dev) Pushes() <-chan string {
+	return d.pushChan()
+}
+
+// Internal
+
+// waiter is a command waiting for its reply from the read pump.
+type waiter struct {
+	code string
+	// raw is true when the reply may not be wrapped. The next message is then
+	// assumed to be the reply.
+	raw bool
+	ch  chan string
+}
+
+// startPump starts the read pump.
+//
+// d.mu must be held or d not yet shared.
+func (d *Dev) startPump() {
+	pushes := make(chan string, 16)
+	d.pumpMu.Lock()
+	d.pushes = pushes
+	d.pumpMu.Unlock()
+	d.pumpDone = make(chan struct{})
+	d.pumpErr = nil
+	go d.pump(d.conn, pushes, d.pumpDone)
+}
+
+// pushChan returns the current pushes channel.
+//
+// It is replaced on reconnection, which holds d.mu, so the callers not
+// holding d.mu must use it instead of reading d.pushes.
+func (d *Dev) pushChan() chan string {
+	d.pumpMu.Lock()
+	defer d.pumpMu.Unlock()
+	return d.pushes
+}
+
+// pump reads conn until it fails and dispatches the messages.
+func (d *Dev) pump(conn io.Reader, pushes chan<- string, done chan<- struct{}) {
+	defer close(done)
+	buf := ""
+	b := [4096]byte{}
+	for {
+		n, err := d.read(conn, b[:])
+		buf += string(b[:n])
+		for {
+			msg, code := nextMessage(buf)
+			if msg == "" {
+				break
+			}
+			buf = buf[len(msg):]
+			d.dispatch(pushes, msg, code)
+		}
+		if err == nil && d.maxResponse > 0 && len(buf) > d.maxResponse {
+			err = ErrResponseTooLarge
+		}
+		if err != nil {
+			log.Printf("pump: %s", err)
+			d.pumpErr = err
+			close(pushes)
+			return
+		}
+	}
+}
+
+// dispatch sends the message to the waiting command if it is its reply,
+// otherwise to pushes.
+func (d *Dev) dispatch(pushes chan<- string, msg, code string) {
+	d.pumpMu.Lock()
+	w := d.waiter
+	if w != nil && (w.raw || w.code == code) {
+		d.waiter = nil
+		d.pumpMu.Unlock()
+		w.ch <- msg
+		return
+	}
+	d.pumpMu.Unlock()
+	select {
+	case pushes <- msg:
+	default:
+		log.Printf("pump: dropping %q", msg)
+	}
+}
+
+// pumpRoundTrip sends a command and waits for the pump to route its reply.
+//
+// d.mu must be held.
+func (d *Dev) pumpRoundTrip(ctx context.Context, cmd string, raw bool) (string, error) {
+	w := &waiter{code: commandCode(cmd), raw: raw, ch: make(chan string, 1)}
+	d.pumpMu.Lock()
+	d.waiter = w
+	d.pumpMu.Unlock()
+	defer func() {
+		d.pumpMu.Lock()
+		if d.waiter == w {
+			d.waiter = nil
+		}
+		d.pumpMu.Unlock()
+	}()
+	if err := d.write(ctx, []byte("~"+cmd+"\n")); err != nil {
+		log.Printf("sendCommand(%q): %s", cmd, err)
+		return "", err
+	}
+	select {
+	case resp := <-w.ch:
+		return resp, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case <-d.pumpDone:
+		if d.pumpErr == nil {
+			return "", ErrClosed
+		}
+		return "", d.pumpErr
+	}
+}
+
+// readPushes calls f for each message the printer sends on its own until ctx
+// is done, the connection fails or f returns an error.
+//
+// Without the read pump, it reads the connection directly so d.mu must be
+// held. With it, it stops once the connection is closed, including by a
+// reconnection.
+func (d *Dev) readPushes(ctx context.Context, f func(msg string) error) error {
+	if pushes := d.pushChan(); pushes != nil {
+		for {
+			select {
+			case msg, ok := <-pushes:
+				if !ok {
+					return ErrClosed
+				}
+				if err := f(msg); err != nil {
+					return err
+				}
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	return d.withContext(ctx, func() error {
+		buf := ""
+		b := [4096]byte{}
+		for {
+			n, err := d.read(d.conn, b[:])
+			if err != nil {
+				return err
+			}
+			buf += string(b[:n])
+			for {
+				msg, _ := nextMessage(buf)
+				if msg == "" {
+					break
+				}
+				buf = buf[len(msg):]
+				if err := f(msg); err != nil {
+					return err
+				}
+			}
+		}
+	})
+}
+
+// nextMessage returns the first complete message in buf, either a wrapped
+// reply "CMD X Received.\r\n" ... "ok\r\n" along its command code, or a single
+// line.
+//
+// It returns an empty msg if buf doesn't contain a complete message yet.
+func nextMessage(buf string) (msg, code string) {
+	if len(buf) < len("CMD ") && strings.HasPrefix("CMD ", buf) {
+		return "", ""
+	}
+	if strings.HasPrefix(buf, "CMD ") {
+		i := okIndex(buf)
+		if i == -1 {
+			return "", ""
+		}
+		code = buf[len("CMD "):]
+		if j := strings.IndexByte(code, ' '); j != -1 {
+			code = code[:j]
+		}
+		return buf[:i], code
+	}
+	i := strings.IndexByte(buf, '\n')
+	if i == -1 {
+		return "", ""
+	}
+	return buf[:i+1], ""
+}
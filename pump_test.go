@@ -0,0 +1,188 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package ffa3
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNextMessage(t *testing.T) {
+	data := []struct {
+		in   string
+		msg  string
+		code string
+	}{
+		{"", "", ""},
+		{"CM", "", ""},
+		{"CMD M105 Received.\r\nT0:22", "", ""},
+		{"CMD M105 Received.\r\nT0:22\r\nok\r\nCMD", "CMD M105 Received.\r\nT0:22\r\nok\r\n", "M105"},
+		{"CMD M105 Received.\nT0:22\nok\nCMD", "CMD M105 Received.\nT0:22\nok\n", "M105"},
+		{"ok\r\nCMD M27", "ok\r\n", ""},
+		{"partial", "", ""},
+	}
+	for i, line := range data {
+		msg, code := nextMessage(line.in)
+		if msg != line.msg || code != line.code {
+			t.Fatalf("#%d: got %q %q, want %q %q", i, msg, code, line.msg, line.code)
+		}
+	}
+}
+
+func TestPump_Interleaved(t *testing.T) {
+	// The M27 auto reports arrive before and after the M105 reply, split
+	// across reads.
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	d := &Dev{conn: client}
+	d.startPump()
+	go func() {
+		r := bufio.NewReader(server)
+		if _, err := r.ReadString('\n'); err != nil {
+			return
+		}
+		server.Write([]byte("CMD M27 Received.\r\nSD printing byte 1/100\r\nok\r\nCMD M105 Rec"))
+		server.Write([]byte("eived.\r\nT0:22 /0 B:17/0\r\nok\r\nCMD M27 Received.\r\nSD printing byte 2/100\r\nok\r\n"))
+	}()
+	resp, err := d.sendCommand("M105")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp != "T0:22 /0 B:17/0" {
+		t.Fatalf("unexpected reply %q", resp)
+	}
+	var got []string
+	for len(got) != 2 {
+		got = append(got, <-d.Pushes())
+	}
+	want := []string{
+		"CMD M27 Received.\r\nSD printing byte 1/100\r\nok\r\n",
+		"CMD M27 Received.\r\nSD printing byte 2/100\r\nok\r\n",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestPump_Dispatch(t *testing.T) {
+	d := &Dev{pushes: make(chan string, 1)}
+	w := &waiter{code: "M105", ch: make(chan string, 1)}
+	d.waiter = w
+	// Another command's reply is a push.
+	d.dispatch(d.pushes, "CMD M27 Received.\r\nok\r\n", "M27")
+	if d.waiter != w {
+		t.Fatal("waiter was consumed")
+	}
+	if got := <-d.pushes; got != "CMD M27 Received.\r\nok\r\n" {
+		t.Fatal(got)
+	}
+	d.dispatch(d.pushes, "CMD M105 Received.\r\nok\r\n", "M105")
+	if d.waiter != nil {
+		t.Fatal("waiter was not consumed")
+	}
+	if got := <-w.ch; got != "CMD M105 Received.\r\nok\r\n" {
+		t.Fatal(got)
+	}
+
+	// A raw waiter takes whatever comes next.
+	w = &waiter{code: "M112", raw: true, ch: make(chan string, 1)}
+	d.waiter = w
+	d.dispatch(d.pushes, "ok\r\n", "")
+	if got := <-w.ch; got != "ok\r\n" {
+		t.Fatal(got)
+	}
+
+	// The pushes are dropped instead of blocking the pump when not drained.
+	d.dispatch(d.pushes, "a\n", "")
+	d.dispatch(d.pushes, "b\n", "")
+	if got := <-d.pushes; got != "a\n" {
+		t.Fatal(got)
+	}
+	select {
+	case got := <-d.pushes:
+		t.Fatalf("unexpected %q", got)
+	default:
+	}
+}
+
+func TestPump_Error(t *testing.T) {
+	c := &failingConn{written: make(chan struct{})}
+	d := &Dev{conn: c}
+	d.startPump()
+	// The connection fails while the command waits for its reply.
+	if _, err := d.pumpRoundTrip(context.Background(), "M105", false); err != errFailing {
+		t.Fatal(err)
+	}
+	// Then right away.
+	if _, err := d.pumpRoundTrip(context.Background(), "M105", false); err != errFailing {
+		t.Fatal(err)
+	}
+	if _, ok := <-d.Pushes(); ok {
+		t.Fatal("pushes is not closed")
+	}
+}
+
+func TestPump_SubscribeJobStatus(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect(WithReadPump())
+	f.reset()
+	f.set("M27", "SD printing byte 10/100")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, err := d.SubscribeJobStatus(ctx, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j := <-c; j.Printed != 10 {
+		t.Fatalf("unexpected %+v", j)
+	}
+	// Other commands proceed during the subscription.
+	if _, err := d.sendCommand("M105"); err != nil {
+		t.Fatal(err)
+	}
+	f.push("CMD M27 Received.\r\nSD printing byte 20/100\r\nok\r\n")
+	if j := <-c; j.Printed != 20 {
+		t.Fatalf("unexpected %+v", j)
+	}
+	cancel()
+	for range c {
+	}
+	if want := []string{"M27 S2", "M105", "M27 S0"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+}
+
+//
+
+var errFailing = errors.New("failing")
+
+// failingConn fails reading once written to.
+type failingConn struct {
+	written chan struct{}
+}
+
+func (f *failingConn) Read(b []byte) (int, error) {
+	<-f.written
+	return 0, errFailing
+}
+
+func (f *failingConn) Write(b []byte) (int, error) {
+	select {
+	case <-f.written:
+	default:
+		close(f.written)
+	}
+	return len(b), nil
+}
+
+func (f *failingConn) Close() error {
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package ffa3
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Internal
+
+// experimentalQueue enables the print queue commands.
+//
+// TODO(maruel): The codes are unconfirmed, they were never tried on a
+// firmware with a queue; the ones without it don't report "Queue Size: " in
+// M115. Export queueList and queueCancel once confirmed.
+var experimentalQueue = false
+
+const (
+	queueListCmd   = "M2020"
+	queueCancelCmd = "M2021"
+)
+
+// queuedJob is a job waiting in the printer's print queue.
+type queuedJob struct {
+	ID       int
+	Filename string
+}
+
+// queueList returns the jobs waiting in the printer's print queue.
+//
+// It returns ErrUnsupported unless experimentalQueue and
+// Capabilities.HasQueue.
+func (d *Dev) queueList() ([]queuedJob, error) {
+	if !experimentalQueue || !d.caps.HasQueue {
+		return nil, ErrUnsupported
+	}
+	resp, err := d.sendQuery(queueListCmd)
+	if err != nil {
+		return nil, err
+	}
+	return parseQueue(resp)
+}
+
+// queueCancel removes the job id from the printer's print queue.
+//
+// It returns ErrUnsupported unless experimentalQueue and
+// Capabilities.HasQueue.
+func (d *Dev) queueCancel(id int) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	if !experimentalQueue || !d.caps.HasQueue {
+		return ErrUnsupported
+	}
+	resp, err := d.sendCommand(formatCmd(queueCancelCmd, fmt.Sprintf("S%d", id)))
+	if resp != "" {
+		return fmt.Errorf("unknown reply: %q", resp)
+	}
+	return err
+}
+
+// parseQueue parses a queue listing, e.g.:
+//
+//	Queue: 2
+//	1: benchy.gx
+//	2: cube.gx
+func parseQueue(resp string) ([]queuedJob, error) {
+	lines := splitLines(resp)
+	if len(lines) == 0 || !strings.HasPrefix(lines[0], "Queue: ") {
+		return nil, fmt.Errorf("unknown reply: %q", resp)
+	}
+	n, err := strconv.Atoi(lines[0][len("Queue: "):])
+	if err != nil || n != len(lines)-1 {
+		return nil, fmt.Errorf("unknown reply: %q", resp)
+	}
+	out := make([]queuedJob, 0, n)
+	for _, line := range lines[1:] {
+		i := strings.Index(line, ": ")
+		if i == -1 {
+			return nil, fmt.Errorf("unknown reply: %q", line)
+		}
+		id, err := strconv.Atoi(line[:i])
+		if err != nil {
+			return nil, fmt.Errorf("unknown reply: %q", line)
+		}
+		out = append(out, queuedJob{ID: id, Filename: line[i+2:]})
+	}
+	return out, nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package ffa3
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseQueue(t *testing.T) {
+	got, err := parseQueue("Queue: 2\r\n1: benchy.gx\r\n2: cube.gx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []queuedJob{{ID: 1, Filename: "benchy.gx"}, {ID: 2, Filename: "cube.gx"}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	if got, err := parseQueue("Queue: 0"); len(got) != 0 || err != nil {
+		t.Fatal(got, err)
+	}
+	for _, in := range []string{"", "Queue: x", "Queue: 2\r\n1: benchy.gx", "Queue: 1\r\nbenchy.gx", "Queue: 1\r\nx: benchy.gx"} {
+		if _, err := parseQueue(in); err == nil {
+			t.Fatalf("%q: expected error", in)
+		}
+	}
+}
+
+func TestQueue(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	// Without a queue, no command is sent.
+	if _, err := d.queueList(); err != ErrUnsupported {
+		t.Fatal(err)
+	}
+	if err := d.queueCancel(1); err != ErrUnsupported {
+		t.Fatal(err)
+	}
+	if got := f.received(); len(got) != 0 {
+		t.Fatalf("unexpected commands %q", got)
+	}
+
+	// With a queue, the commands are still not sent until confirmed.
+	f = newFakePrinter(t)
+	f.set("M115", "Machine Type: Flashforge Adventurer III\r\nQueue Size: 4")
+	d = f.connect()
+	f.reset()
+	if !d.Capabilities().HasQueue || d.Capabilities().Supports(queueListCmd) {
+		t.Fatal("unexpected queue support")
+	}
+	if _, err := d.queueList(); err != ErrUnsupported {
+		t.Fatal(err)
+	}
+	if got := f.received(); len(got) != 0 {
+		t.Fatalf("unexpected commands %q", got)
+	}
+
+	experimentalQueue = true
+	defer func() { experimentalQueue = false }()
+	f = newFakePrinter(t)
+	f.set("M115", "Machine Type: Flashforge Adventurer III\r\nQueue Size: 4")
+	f.set(queueListCmd, "Queue: 1\r\n3: benchy.gx")
+	d = f.connect()
+	f.reset()
+	if !d.Capabilities().Supports(queueCancelCmd) {
+		t.Fatal("queue not detected")
+	}
+	got, err := d.queueList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []queuedJob{{ID: 3, Filename: "benchy.gx"}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	if err := d.queueCancel(3); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"M2020", "M2021 S3"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+}
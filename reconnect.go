@@ -0,0 +1,139 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package ffa3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"syscall"
+	"time"
+)
+
+// WithAutoReconnect makes the query methods reconnect and retry once when the
+// connection is reset, so long running monitors survive transient network
+// issues.
+//
+// Commands changing the printer state are never retried. It only works with
+// Connect and ConnectContext.
+func WithAutoReconnect() Option {
+	return func(o *options) {
+		o.autoReconnect = true
+	}
+}
+
+// Reconnect closes the connection and connects to the printer again.
+//
+// The tracked state, e.g. the positioning mode, is reset. With WithReadPump,
+// Pushes returns a new channel afterward.
+func (d *Dev) Reconnect(ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.reconnect(ctx)
+}
+
+// Reset resynchronizes the tracked state after a recoverable error, short of
+// a full reconnection, and switches the printer to absolute positioning (G90).
+//
+// It discards pending bytes, sends G90 except with WithReadOnly, and verifies
+// the printer replies by querying the temperatures. Callers relying on
+// relative positioning must call SetPositioningMode again.
+func (d *Dev) Reset() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ctx := context.Background()
+	d.drain()
+	d.positioning = modeUnknown
+	d.extrusion = modeUnknown
+	if !d.readOnly {
+		if err := d.setPositioningMode(ctx, true); err != nil {
+			return err
+		}
+	}
+	resp, err := d.send(ctx, "M105")
+	if err != nil {
+		return err
+	}
+	t := Temperatures{}
+	_, _, err = parseTemp(resp, &t)
+	return err
+}
+
+// Internal
+
+// dial connects to the printer's control port.
+func dial(ctx context.Context, ip string, timeout time.Duration) (net.Conn, error) {
+	conn, err := (&net.Dialer{Timeout: timeout}).DialContext(ctx, "tcp", ip+":8899")
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", ip, err)
+	}
+	return conn, nil
+}
+
+// reconnect is Reconnect with d.mu held.
+func (d *Dev) reconnect(ctx context.Context) error {
+	if d.ip == "" {
+		return errors.New("can't reconnect a Dev created with NewDev")
+	}
+	if d.closed {
+		return ErrClosed
+	}
+	d.setState(StateConnecting)
+	d.conn.Close()
+	if d.pushes != nil {
+		// Wait for the pump to stop reading the old connection.
+		<-d.pumpDone
+	}
+	conn, err := dial(ctx, d.ip, d.dialTimeout)
+	if err != nil {
+		d.setState(StateError)
+		return err
+	}
+	d.conn = conn
+	d.positioning = modeUnknown
+	d.extrusion = modeUnknown
+	if d.pushes != nil {
+		d.startPump()
+	}
+	if !d.readOnly {
+		if err := d.sendHello(ctx); err != nil {
+			if err != ErrBusy {
+				d.setState(StateError)
+			}
+			return err
+		}
+	}
+	d.setState(StateConnected)
+	return nil
+}
+
+// sendQuery is sendCommand for queries, which are retried once after
+// reconnecting when WithAutoReconnect is used.
+func (d *Dev) sendQuery(cmd string) (string, error) {
+	return d.sendQueryContext(context.Background(), cmd)
+}
+
+// sendQueryContext is sendQuery bounded by ctx.
+func (d *Dev) sendQueryContext(ctx context.Context, cmd string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	resp, err := d.send(ctx, cmd)
+	if err != nil && d.autoReconnect && isConnReset(err) {
+		log.Printf("sendQuery(%q): %s; reconnecting", cmd, err)
+		if err2 := d.reconnect(ctx); err2 != nil {
+			return resp, fmt.Errorf("%w; failed to reconnect: %v", err, err2)
+		}
+		resp, err = d.send(ctx, cmd)
+	}
+	return resp, err
+}
+
+// isConnReset returns true if the error means the connection was dropped.
+func isConnReset(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
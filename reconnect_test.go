@@ -0,0 +1,134 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package ffa3
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestAutoReconnect(t *testing.T) {
+	f := listenFakePrinter(t)
+	d, err := Connect("127.0.0.1", WithAutoReconnect())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	f.reset()
+	f.drop()
+	// The query is retried on a new connection.
+	if err := d.QueryTemp(&Temperatures{}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"M601 S1", "M105"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+	// Commands are not retried.
+	f.drop()
+	if err := d.SetLight(true); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestReconnect_Pump(t *testing.T) {
+	f := listenFakePrinter(t)
+	d, err := Connect("127.0.0.1", WithReadPump())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	old := d.Pushes()
+	if err := d.Reconnect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// The old pump stopped and a new one serves the new connection.
+	if _, ok := <-old; ok {
+		t.Fatal("old pushes is not closed")
+	}
+	if d.Pushes() == old {
+		t.Fatal("pushes was not replaced")
+	}
+	f.reset()
+	if err := d.QueryTemp(&Temperatures{}); err != nil {
+		t.Fatal(err)
+	}
+	f.push("CMD M27 Received.\r\nSD printing byte 1/100\r\nok\r\n")
+	if got := <-d.Pushes(); got != "CMD M27 Received.\r\nSD printing byte 1/100\r\nok\r\n" {
+		t.Fatal(got)
+	}
+}
+
+func TestReconnect_PumpConcurrent(t *testing.T) {
+	// Run with -race: Pushes() is read while Reconnect replaces the channel.
+	listenFakePrinter(t)
+	d, err := Connect("127.0.0.1", WithReadPump())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_ = d.Pushes()
+		}
+	}()
+	if err := d.Reconnect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+}
+
+func TestReconnect_NewDev(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	if err := d.Reconnect(context.Background()); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestReset(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	if err := d.SetPositioningMode(false); err != nil {
+		t.Fatal(err)
+	}
+	f.reset()
+	if err := d.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	// The positioning mode is forced back to absolute.
+	if want := []string{"G90", "M105"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+	if d.positioning != modeAbsolute {
+		t.Fatal(d.positioning)
+	}
+
+	f = newFakePrinter(t)
+	d = f.connect(WithReadOnly())
+	f.reset()
+	if err := d.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"M105"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+}
+
+func TestIsConnReset(t *testing.T) {
+	for i, err := range []error{io.EOF, io.ErrUnexpectedEOF, syscall.ECONNRESET, syscall.EPIPE} {
+		if !isConnReset(err) {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	if isConnReset(errors.New("other")) {
+		t.Fatal("unexpected")
+	}
+}
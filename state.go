@@ -0,0 +1,71 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package ffa3
+
+import (
+	"errors"
+	"net"
+)
+
+// State is the connection state, as opposed to the printer's MachineState.
+type State uint8
+
+// Valid State values.
+const (
+	StateDisconnected State = iota
+	StateConnecting
+	StateConnected
+	// StateBusy means another client has control of the printer.
+	StateBusy
+	// StateError means the last command failed on an I/O error.
+	StateError
+)
+
+func (s State) String() string {
+	switch s {
+	case StateDisconnected:
+		return "Disconnected"
+	case StateConnecting:
+		return "Connecting"
+	case StateConnected:
+		return "Connected"
+	case StateBusy:
+		return "Busy"
+	case StateError:
+		return "Error"
+	default:
+		return "State(?)"
+	}
+}
+
+// State returns the connection state.
+func (d *Dev) State() State {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	return d.state
+}
+
+// Internal
+
+func (d *Dev) setState(s State) {
+	d.stateMu.Lock()
+	d.state = s
+	d.stateMu.Unlock()
+}
+
+// trackState updates the state after a command completed with err.
+func (d *Dev) trackState(err error) {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	if d.state == StateDisconnected || d.state == StateConnecting {
+		return
+	}
+	var nerr net.Error
+	if err == nil {
+		d.state = StateConnected
+	} else if isConnReset(err) || errors.As(err, &nerr) || err == ErrResponseTooLarge {
+		d.state = StateError
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package ffa3
+
+import (
+	"context"
+	"testing"
+)
+
+func TestState(t *testing.T) {
+	f := listenFakePrinter(t)
+	d, err := Connect("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := d.State(); s != StateConnected {
+		t.Fatal(s)
+	}
+	f.drop()
+	if err := d.QueryTemp(&Temperatures{}); err == nil {
+		t.Fatal("expected error")
+	}
+	if s := d.State(); s != StateError {
+		t.Fatal(s)
+	}
+	if err := d.Reconnect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if s := d.State(); s != StateConnected {
+		t.Fatal(s)
+	}
+	d.Close()
+	if s := d.State(); s != StateDisconnected {
+		t.Fatal(s)
+	}
+}
+
+func TestState_Busy(t *testing.T) {
+	f := newFakePrinter(t)
+	f.set("M601", "Control failed.")
+	d := &Dev{conn: f.client, state: StateConnecting}
+	d.mu.Lock()
+	err := d.sendHello(context.Background())
+	d.mu.Unlock()
+	if err != ErrBusy {
+		t.Fatal(err)
+	}
+	if s := d.State(); s != StateBusy {
+		t.Fatal(s)
+	}
+}
+
+func TestState_String(t *testing.T) {
+	data := []struct {
+		s    State
+		want string
+	}{
+		{StateDisconnected, "Disconnected"},
+		{StateConnecting, "Connecting"},
+		{StateConnected, "Connected"},
+		{StateBusy, "Busy"},
+		{StateError, "Error"},
+		{State(99), "State(?)"},
+	}
+	for i, line := range data {
+		if got := line.s.String(); got != line.want {
+			t.Fatalf("#%d: got %q", i, got)
+		}
+	}
+}
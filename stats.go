@@ -0,0 +1,73 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package ffa3
+
+import (
+	"strings"
+	"time"
+)
+
+// Stats is the statistics of the commands sent since connecting.
+type Stats struct {
+	Commands int64
+	Errors   int64
+	// PerCommand is keyed by command code, e.g. "M105".
+	PerCommand map[string]CommandStats
+	_          struct{}
+}
+
+// CommandStats is the statistics of a command code.
+type CommandStats struct {
+	Count  int64
+	Errors int64
+	// Total is the sum of the round trip times.
+	Total time.Duration
+	_     struct{}
+}
+
+// Average returns the average round trip time.
+func (c CommandStats) Average() time.Duration {
+	if c.Count == 0 {
+		return 0
+	}
+	return c.Total / time.Duration(c.Count)
+}
+
+// Stats returns the statistics of the commands sent since connecting.
+func (d *Dev) Stats() Stats {
+	d.statsMu.Lock()
+	defer d.statsMu.Unlock()
+	s := Stats{PerCommand: make(map[string]CommandStats, len(d.stats))}
+	for k, v := range d.stats {
+		s.Commands += v.Count
+		s.Errors += v.Errors
+		s.PerCommand[k] = *v
+	}
+	return s
+}
+
+// Internal
+
+// record updates the statistics for cmd.
+func (d *Dev) record(cmd string, dur time.Duration, err error) {
+	// Key by the bare code so line numbered and checksummed lines don't each
+	// get their own entry.
+	code := strings.ToUpper(commandCode(cmd))
+	d.statsMu.Lock()
+	defer d.statsMu.Unlock()
+	c := d.stats[code]
+	if c == nil {
+		if d.stats == nil {
+			d.stats = map[string]*CommandStats{}
+		}
+		c = &CommandStats{}
+		d.stats[code] = c
+	}
+	c.Count++
+	c.Total += dur
+	if err != nil {
+		c.Errors++
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package ffa3
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	before := d.Stats()
+	for i := 0; i < 3; i++ {
+		if _, err := d.sendCommand("M105"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d.mu.Lock()
+	_, err := d.send(ctx, "M146 r0 g0 b0 F0")
+	d.mu.Unlock()
+	if err != context.Canceled {
+		t.Fatal(err)
+	}
+	s := d.Stats()
+	if s.Commands != before.Commands+4 || s.Errors != before.Errors+1 {
+		t.Fatalf("unexpected %+v", s)
+	}
+	c := s.PerCommand["M105"]
+	if c.Count != before.PerCommand["M105"].Count+3 || c.Errors != 0 {
+		t.Fatalf("unexpected %+v", c)
+	}
+	// Average can be called on the map value directly.
+	if avg := d.Stats().PerCommand["M105"].Average(); avg != c.Total/time.Duration(c.Count) {
+		t.Fatal(avg)
+	}
+	if c := s.PerCommand["M146"]; c.Count != 1 || c.Errors != 1 {
+		t.Fatalf("unexpected %+v", c)
+	}
+	if avg := s.PerCommand["M999"].Average(); avg != 0 {
+		t.Fatal(avg)
+	}
+}
+
+func TestStats_CommandCode(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	d.mu.Lock()
+	for _, cmd := range []string{withChecksum(1, "G1 X1"), withChecksum(2, "G1 X2"), "g1 X3"} {
+		if _, err := d.send(context.Background(), cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.mu.Unlock()
+	// The line numbers, checksums and case don't split the entries.
+	s := d.Stats()
+	if c := s.PerCommand["G1"]; c.Count != 3 {
+		t.Fatalf("unexpected %+v", s.PerCommand)
+	}
+	for k := range s.PerCommand {
+		if k != "G1" && k != "M601" && k != "M115" && k != "M105" && k != "M119" {
+			t.Fatalf("unexpected key %q", k)
+		}
+	}
+}
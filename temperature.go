@@ -0,0 +1,239 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package ffa3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"periph.io/x/conn/v3/physic"
+)
+
+// ErrOverTemperature is returned by SafetyWatch when it stopped the printer.
+var ErrOverTemperature = errors.New("over temperature")
+
+// WithKeepHeatingOnCancel makes HeatExtruderAndWait and HeatBedAndWait leave
+// the heater on when their context is canceled. By default, the heater is
+// turned off.
+func WithKeepHeatingOnCancel() Option {
+	return func(o *options) {
+		o.keepHeating = true
+	}
+}
+
+// SetExtruderTemperature sets the extruder target temperature. Use 0°C to turn
+// the heater off.
+func (d *Dev) SetExtruderTemperature(t physic.Temperature) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	if err := d.checkExtruderTemp(t); err != nil {
+		return err
+	}
+	resp, err := d.sendCommand(formatCmd("M104", fmt.Sprintf("S%d", toCelsius(t)), "T0"))
+	if resp != "" {
+		return fmt.Errorf("unknown reply: %q", resp)
+	}
+	return err
+}
+
+// SetBedTemperature sets the bed target temperature. Use 0°C to turn the
+// heater off.
+//
+// It returns ErrUnsupported on printers without a heated bed.
+func (d *Dev) SetBedTemperature(t physic.Temperature) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	if !d.caps.Supports("M140") {
+		return ErrUnsupported
+	}
+	if err := d.checkBedTemp(t); err != nil {
+		return err
+	}
+	resp, err := d.sendCommand(formatCmd("M140", fmt.Sprintf("S%d", toCelsius(t))))
+	if resp != "" {
+		return fmt.Errorf("unknown reply: %q", resp)
+	}
+	return err
+}
+
+// SetTemperatures sets the extruder and bed target temperatures in one go.
+//
+// Only the non-zero ExtruderTarget and BedTarget of t are sent; use 0°C to turn
+// a heater off. The current temperatures are ignored so a Temperatures from
+// QueryTemp can be passed back. The bed is skipped on printers without a
+// heated bed. The chamber is ignored, use SetChamberTemperature.
+func (d *Dev) SetTemperatures(t Temperatures) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	var cmds []string
+	if t.ExtruderTarget != 0 {
+		if err := d.checkExtruderTemp(t.ExtruderTarget); err != nil {
+			return err
+		}
+		cmds = append(cmds, formatCmd("M104", fmt.Sprintf("S%d", toCelsius(t.ExtruderTarget)), "T0"))
+	}
+	if t.BedTarget != 0 && d.caps.HasHeatedBed {
+		if err := d.checkBedTemp(t.BedTarget); err != nil {
+			return err
+		}
+		cmds = append(cmds, formatCmd("M140", fmt.Sprintf("S%d", toCelsius(t.BedTarget))))
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, cmd := range cmds {
+		resp, err := d.send(context.Background(), cmd)
+		if resp != "" {
+			return fmt.Errorf("unknown reply: %q", resp)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WaitForExtruderTemperature polls the temperatures until the extruder
+// reaches target.
+func (d *Dev) WaitForExtruderTemperature(ctx context.Context, target physic.Temperature) error {
+	return d.waitForTemp(ctx, func(t *Temperatures) bool { return t.Extruder >= target-tempTolerance })
+}
+
+// WaitForBedTemperature polls the temperatures until the bed reaches target.
+func (d *Dev) WaitForBedTemperature(ctx context.Context, target physic.Temperature) error {
+	return d.waitForTemp(ctx, func(t *Temperatures) bool { return t.Bed >= target-tempTolerance })
+}
+
+// HeatExtruderAndWait sets the extruder target temperature and waits for it to
+// be reached.
+//
+// If ctx is canceled while heating, the heater is turned off unless
+// WithKeepHeatingOnCancel was used.
+func (d *Dev) HeatExtruderAndWait(ctx context.Context, target physic.Temperature) error {
+	if err := d.SetExtruderTemperature(target); err != nil {
+		return err
+	}
+	err := d.WaitForExtruderTemperature(ctx, target)
+	if err != nil && ctx.Err() != nil && !d.keepHeating {
+		if err2 := d.SetExtruderTemperature(physic.ZeroCelsius); err2 != nil {
+			log.Printf("failed to turn off the extruder heater: %s", err2)
+		}
+	}
+	return err
+}
+
+// HeatBedAndWait sets the bed target temperature and waits for it to be
+// reached.
+//
+// If ctx is canceled while heating, the heater is turned off unless
+// WithKeepHeatingOnCancel was used.
+func (d *Dev) HeatBedAndWait(ctx context.Context, target physic.Temperature) error {
+	if err := d.SetBedTemperature(target); err != nil {
+		return err
+	}
+	err := d.WaitForBedTemperature(ctx, target)
+	if err != nil && ctx.Err() != nil && !d.keepHeating {
+		if err2 := d.SetBedTemperature(physic.ZeroCelsius); err2 != nil {
+			log.Printf("failed to turn off the bed heater: %s", err2)
+		}
+	}
+	return err
+}
+
+// SafetyWatch polls the temperatures every poll and does a FullStop as soon as
+// the extruder exceeds maxExtruder or the bed exceeds maxBed, as a thermal
+// runaway guard. Use 0 to not watch one of them.
+//
+// It runs until ctx is done or it tripped, in which case it returns an
+// ErrOverTemperature wrapped error stating the reason.
+func (d *Dev) SafetyWatch(ctx context.Context, maxExtruder, maxBed physic.Temperature, poll time.Duration) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	for {
+		t := Temperatures{}
+		if err := d.QueryTemp(&t); err != nil {
+			return err
+		}
+		reason := ""
+		if maxExtruder != 0 && t.Extruder > maxExtruder {
+			reason = fmt.Sprintf("extruder at %s exceeds %s", t.Extruder, maxExtruder)
+		} else if maxBed != 0 && t.Bed > maxBed {
+			reason = fmt.Sprintf("bed at %s exceeds %s", t.Bed, maxBed)
+		}
+		if reason != "" {
+			if err := d.FullStop(); err != nil {
+				return fmt.Errorf("%w: %s; failed to stop: %v", ErrOverTemperature, reason, err)
+			}
+			return fmt.Errorf("%w: %s", ErrOverTemperature, reason)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(poll):
+		}
+	}
+}
+
+// Internal
+
+const (
+	// maxExtruderTemp and maxBedTemp are the defaults when the firmware
+	// doesn't report its limits.
+	maxExtruderTemp = physic.ZeroCelsius + 265*physic.Celsius
+	maxBedTemp      = physic.ZeroCelsius + 100*physic.Celsius
+	// tempTolerance is how close to the target a temperature is considered
+	// reached.
+	tempTolerance = 2 * physic.Celsius
+	// tempPoll is the interval between M105 queries while waiting.
+	tempPoll = time.Second
+)
+
+// waitForTemp polls M105 until reached returns true.
+func (d *Dev) waitForTemp(ctx context.Context, reached func(t *Temperatures) bool) error {
+	for {
+		t := Temperatures{}
+		if err := d.QueryTemp(&t); err != nil {
+			return err
+		}
+		if reached(&t) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(tempPoll):
+		}
+	}
+}
+
+// checkExtruderTemp returns an error if t is not a valid extruder target.
+func (d *Dev) checkExtruderTemp(t physic.Temperature) error {
+	max := d.caps.MaxExtruderTemp
+	if max == 0 {
+		max = maxExtruderTemp
+	}
+	if t < physic.ZeroCelsius || t > max {
+		return fmt.Errorf("invalid extruder temperature %s: must be between 0°C and %s", t, max)
+	}
+	return nil
+}
+
+// checkBedTemp returns an error if t is not a valid bed target.
+func (d *Dev) checkBedTemp(t physic.Temperature) error {
+	max := d.caps.MaxBedTemp
+	if max == 0 {
+		max = maxBedTemp
+	}
+	if t < physic.ZeroCelsius || t > max {
+		return fmt.Errorf("invalid bed temperature %s: must be between 0°C and %s", t, max)
+	}
+	return nil
+}
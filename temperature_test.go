@@ -0,0 +1,186 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package ffa3
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetTemperature(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	if err := d.SetExtruderTemperature(celsius(200)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetBedTemperature(celsius(60)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetExtruderTemperature(celsius(300)); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := d.SetBedTemperature(celsius(-1)); err == nil {
+		t.Fatal("expected error")
+	}
+	if want := []string{"M104 S200 T0", "M140 S60"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+}
+
+func TestSetTemperature_FirmwareMax(t *testing.T) {
+	f := newFakePrinter(t)
+	f.set("M115", "Machine Type: Flashforge Adventurer III\r\nMax Extruder Temp: 240\r\nMax Bed Temp: 80")
+	d := f.connect()
+	f.reset()
+	if c := d.Capabilities(); c.MaxExtruderTemp != celsius(240) || c.MaxBedTemp != celsius(80) {
+		t.Fatalf("unexpected limits %s %s", c.MaxExtruderTemp, c.MaxBedTemp)
+	}
+	// Below the defaults but above the firmware's limits.
+	if err := d.SetExtruderTemperature(celsius(250)); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := d.SetBedTemperature(celsius(90)); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := d.SetExtruderTemperature(celsius(240)); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"M104 S240 T0"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+}
+
+func TestHeatAndWait(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	f.set("M105", "T0:199 /200 B:17/0")
+	if err := d.HeatExtruderAndWait(context.Background(), celsius(200)); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"M104 S200 T0", "M105"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+}
+
+func TestHeatAndWait_Cancel(t *testing.T) {
+	data := []struct {
+		keep bool
+		heat func(d *Dev, ctx context.Context) error
+		want []string
+	}{
+		{
+			heat: func(d *Dev, ctx context.Context) error { return d.HeatExtruderAndWait(ctx, celsius(200)) },
+			want: []string{"M104 S200 T0", "M105", "M104 S0 T0"},
+		},
+		{
+			heat: func(d *Dev, ctx context.Context) error { return d.HeatBedAndWait(ctx, celsius(60)) },
+			want: []string{"M140 S60", "M105", "M140 S0"},
+		},
+		{
+			keep: true,
+			heat: func(d *Dev, ctx context.Context) error { return d.HeatBedAndWait(ctx, celsius(60)) },
+			want: []string{"M140 S60", "M105"},
+		},
+	}
+	for i, line := range data {
+		f := newFakePrinter(t)
+		var opts []Option
+		if line.keep {
+			opts = append(opts, WithKeepHeatingOnCancel())
+		}
+		d := f.connect(opts...)
+		f.reset()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		err := line.heat(d, ctx)
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if got := f.received(); !reflect.DeepEqual(got, line.want) {
+			t.Fatalf("#%d: got %q, want %q", i, got, line.want)
+		}
+	}
+}
+
+func TestSetTemperatures(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	if err := d.SetTemperatures(Temperatures{ExtruderTarget: celsius(200), BedTarget: celsius(60)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetTemperatures(Temperatures{BedTarget: celsius(0)}); err != nil {
+		t.Fatal(err)
+	}
+	// The current temperatures are ignored.
+	if err := d.SetTemperatures(Temperatures{Extruder: celsius(300), ExtruderTarget: celsius(210), Bed: celsius(20)}); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing is sent when any target is above the maximum.
+	if err := d.SetTemperatures(Temperatures{ExtruderTarget: celsius(200), BedTarget: celsius(150)}); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := d.SetTemperatures(Temperatures{ExtruderTarget: celsius(300)}); err == nil {
+		t.Fatal("expected error")
+	}
+	if want := []string{"M104 S200 T0", "M140 S60", "M140 S0", "M104 S210 T0"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+	// The bed is skipped without a heated bed.
+	d.caps.HasHeatedBed = false
+	f.reset()
+	if err := d.SetTemperatures(Temperatures{ExtruderTarget: celsius(200), BedTarget: celsius(60)}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"M104 S200 T0"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+}
+
+func TestSafetyWatch(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	f.set("M105", "T0:200 /200 B:60/60", "T0:200 /200 B:80/60")
+	err := d.SafetyWatch(context.Background(), celsius(250), celsius(70), time.Millisecond)
+	if !errors.Is(err, ErrOverTemperature) || !strings.Contains(err.Error(), "bed at 80°C exceeds 70°C") {
+		t.Fatal(err)
+	}
+	if want := []string{"M105", "M105", "M112"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+
+	// The firmware halts without acknowledging M112.
+	f.reset()
+	f.set("M105", "T0:260 /200 B:60/60")
+	f.mu.Lock()
+	f.custom["M112"] = func(w io.Writer) {}
+	f.mu.Unlock()
+	err = d.SafetyWatch(context.Background(), celsius(250), 0, time.Millisecond)
+	if !errors.Is(err, ErrOverTemperature) || strings.Contains(err.Error(), "failed to stop") {
+		t.Fatal(err)
+	}
+
+	// 0 disables the check.
+	f.reset()
+	f.set("M105", "T0:300 /200 B:80/60")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := d.SafetyWatch(ctx, 0, 0, time.Millisecond); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	for _, cmd := range f.received() {
+		if cmd != "M105" {
+			t.Fatalf("unexpected %q", cmd)
+		}
+	}
+}
@@ -0,0 +1,576 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package ffa3
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInsufficientStorage is returned by UploadGCode when the printer's storage
+// doesn't have enough free space for the file.
+var ErrInsufficientStorage = errors.New("not enough free space on the printer storage")
+
+// UploadOption is an option to UploadGCode.
+type UploadOption func(o *uploadOptions)
+
+// WithProgress calls f as data is sent to the printer, to render a progress
+// bar.
+//
+// f is called after each packet with an increasing sent value that never
+// exceeds total. The last call, with sent == total, happens once the printer
+// confirmed the file is saved.
+func WithProgress(f func(sent, total int64)) UploadOption {
+	return func(o *uploadOptions) {
+		o.progress = f
+	}
+}
+
+// WithSkipValidation disables the check that the data looks like G-code or a
+// .gx file before uploading it.
+func WithSkipValidation() UploadOption {
+	return func(o *uploadOptions) {
+		o.skipValidation = true
+	}
+}
+
+// WithSkipStorageCheck disables the check that the printer has enough free
+// space before uploading.
+//
+// The check is already skipped when the firmware fails to report its storage
+// space.
+func WithSkipStorageCheck() UploadOption {
+	return func(o *uploadOptions) {
+		o.skipStorageCheck = true
+	}
+}
+
+// WithKeepPartialUpload keeps the partially written file on the printer when
+// UploadGCode fails or is canceled. By default it is deleted.
+func WithKeepPartialUpload() UploadOption {
+	return func(o *uploadOptions) {
+		o.keepPartial = true
+	}
+}
+
+// WithChunkSize limits each write to the connection to n bytes, and waits delay
+// between each write.
+//
+// It helps on flaky Wi-Fi networks that choke on large back-to-back writes. By
+// default each 4KiB packet is sent in a single write without delay.
+func WithChunkSize(n int, delay time.Duration) UploadOption {
+	return func(o *uploadOptions) {
+		o.chunkSize = n
+		o.chunkDelay = delay
+	}
+}
+
+// UploadGCode uploads a G-code file to the printer's storage as name.
+//
+// size must be the exact number of bytes r returns. The leading bytes are
+// verified to be either text G-code or a .gx file unless WithSkipValidation is
+// used. The printer's free space is verified unless WithSkipStorageCheck is
+// used. If the transfer fails or ctx is canceled, the file is closed on the
+// printer so it doesn't wait for more data, then deleted unless
+// WithKeepPartialUpload is used.
+func (d *Dev) UploadGCode(ctx context.Context, name string, r io.Reader, size int64, opts ...UploadOption) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	o := uploadOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if !o.skipValidation {
+		n := int64(512)
+		if size < n {
+			n = size
+		}
+		head := make([]byte, n)
+		if _, err := io.ReadFull(r, head); err != nil {
+			return err
+		}
+		if err := validateGCode(head); err != nil {
+			return err
+		}
+		r = io.MultiReader(bytes.NewReader(head), r)
+	}
+	if !o.skipStorageCheck {
+		// Older firmware may not know the command at all, so any failure only
+		// skips the check; a lost connection is caught by M28 below.
+		free, _, err := d.StorageInfo()
+		if err != nil {
+			log.Printf("UploadGCode: storage space unknown, skipping check: %s", err)
+		} else if size > free {
+			return fmt.Errorf("%w: need %d bytes, %d free", ErrInsufficientStorage, size, free)
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	resp, err := d.send(ctx, fmt.Sprintf("M28 %d %s", size, remotePath(name)))
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(resp, "Writing to file: ") {
+		return fmt.Errorf("unknown reply: %q", resp)
+	}
+	if err = d.withContext(ctx, func() error { return d.writePackets(ctx, r, size, &o) }); err != nil {
+		d.abortUpload(remotePath(name), o.keepPartial)
+		return err
+	}
+	// Failing to close the file, including ctx being canceled after the last
+	// packet, leaves it incomplete as much as a failed transfer.
+	if resp, err = d.send(ctx, "M29"); err == nil && resp != "Done saving file." {
+		err = fmt.Errorf("unknown reply: %q", resp)
+	}
+	if err != nil {
+		d.abortUpload(remotePath(name), o.keepPartial)
+		return err
+	}
+	if o.progress != nil {
+		o.progress(size, size)
+	}
+	return nil
+}
+
+// StartPrint starts printing a file previously uploaded with UploadGCode.
+func (d *Dev) StartPrint(name string) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	resp, err := d.sendCommand("M23 " + remotePath(name))
+	if err != nil {
+		return err
+	}
+	// "File opened: foo.gx Size: 1234\r\nFile selected"
+	if !strings.HasPrefix(resp, "File opened: ") {
+		return fmt.Errorf("unknown reply: %q", resp)
+	}
+	d.mu.Lock()
+	d.lastFile = name
+	d.mu.Unlock()
+	return nil
+}
+
+// Reprint starts printing again the current or last printed file, e.g. after
+// the job was stopped.
+//
+// The file is the one reported by the printer, otherwise the last one started
+// with StartPrint.
+func (d *Dev) Reprint() error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	j := Job{}
+	if err := d.QueryJobStatus(&j); err != nil {
+		return err
+	}
+	name := path.Base(j.Filename)
+	if j.Filename == "" {
+		d.mu.Lock()
+		name = d.lastFile
+		d.mu.Unlock()
+	}
+	if name == "" {
+		return errors.New("no file to reprint; none was printed since connecting")
+	}
+	return d.StartPrint(name)
+}
+
+// StorageInfo returns the free and total space of the printer's storage, in
+// bytes.
+//
+// It returns ErrUnsupported if the firmware doesn't report it.
+func (d *Dev) StorageInfo() (free, total int64, err error) {
+	resp, err := d.sendQuery("M39")
+	if err != nil {
+		return 0, 0, err
+	}
+	return parseStorage(resp)
+}
+
+// PrintFile uploads a local file to the printer and starts printing it.
+//
+// The file is stored on the printer under its base name.
+func (d *Dev) PrintFile(ctx context.Context, localPath string, opts ...UploadOption) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	name := filepath.Base(localPath)
+	if err := d.UploadGCode(ctx, name, f, st.Size(), opts...); err != nil {
+		return err
+	}
+	return d.StartPrint(name)
+}
+
+// StreamOption is an option to StreamGCode.
+type StreamOption func(o *streamOptions)
+
+// WithChecksums makes StreamGCode prefix each line with its line number and
+// suffix it with its checksum, e.g. "N3 G1 X10*45", so the printer can detect
+// corrupted lines and ask for them to be sent again.
+func WithChecksums() StreamOption {
+	return func(o *streamOptions) {
+		o.checksums = true
+	}
+}
+
+// StreamGCode sends the G-code read from r line by line, waiting for each
+// command to be acknowledged before sending the next one.
+//
+// Blank lines and comments are skipped. This is much slower than
+// UploadGCode but doesn't write to the printer's storage.
+func (d *Dev) StreamGCode(ctx context.Context, r io.Reader, opts ...StreamOption) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	o := streamOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	// sent keeps the last lines sent when using checksums.
+	sent := sentLines{}
+	if o.checksums {
+		// Reset the printer's line number.
+		resp, err := d.sendCommand("M110 N0")
+		if resp != "" {
+			return fmt.Errorf("unknown reply: %q", resp)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if i := strings.IndexByte(line, ';'); i != -1 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		var err error
+		if o.checksums {
+			err = d.streamLines(ctx, &sent, sent.add(line))
+		} else {
+			d.mu.Lock()
+			if _, err = d.send(ctx, line); err == nil {
+				d.trackMode(line)
+			}
+			d.mu.Unlock()
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+	}
+	return s.Err()
+}
+
+// GCodeWriter returns a writer streaming the G-code written to it to the
+// printer, as StreamGCode does.
+//
+// The writes don't need to be aligned on lines. Close sends the last line, if
+// it is not terminated, and returns the first error encountered while
+// streaming. Once streaming failed, Write returns the error too.
+func (d *Dev) GCodeWriter(ctx context.Context, opts ...StreamOption) io.WriteCloser {
+	r, w := io.Pipe()
+	g := &gcodeWriter{w: w, done: make(chan struct{})}
+	go func() {
+		defer close(g.done)
+		g.err = d.StreamGCode(ctx, r, opts...)
+		// Unblock the pending Write, if any.
+		if g.err != nil {
+			r.CloseWithError(g.err)
+		} else {
+			r.Close()
+		}
+	}()
+	return g
+}
+
+// Internal
+
+// uploadOptions is the processed UploadOption list.
+type uploadOptions struct {
+	progress         func(sent, total int64)
+	skipValidation   bool
+	skipStorageCheck bool
+	chunkSize        int
+	chunkDelay       time.Duration
+	keepPartial      bool
+}
+
+// gcodeWriter is returned by GCodeWriter.
+type gcodeWriter struct {
+	w    *io.PipeWriter
+	done chan struct{}
+	// err is the StreamGCode result, set before done is closed.
+	err error
+}
+
+func (g *gcodeWriter) Write(b []byte) (int, error) {
+	return g.w.Write(b)
+}
+
+func (g *gcodeWriter) Close() error {
+	g.w.Close()
+	<-g.done
+	return g.err
+}
+
+// streamOptions is the processed StreamOption list.
+type streamOptions struct {
+	checksums bool
+}
+
+// maxResends is the number of resend requests tolerated per line.
+const maxResends = 5
+
+// resendHistory is the number of lines kept to be sent again. The printer
+// only asks for the lines still in its small receive buffer.
+const resendHistory = 64
+
+// sentLines is a ring of the last resendHistory lines sent with checksums.
+type sentLines struct {
+	lines [resendHistory]string
+	// last is the number of the last line added, 0 when empty.
+	last int
+}
+
+// add formats line with the next line number and its checksum and returns its
+// number.
+func (s *sentLines) add(line string) int {
+	s.last++
+	s.lines[s.last%resendHistory] = withChecksum(s.last, line)
+	return s.last
+}
+
+// get returns the line number n as sent, if it is still kept.
+func (s *sentLines) get(n int) (string, bool) {
+	if n < 1 || n > s.last || n <= s.last-resendHistory {
+		return "", false
+	}
+	return s.lines[n%resendHistory], true
+}
+
+// streamLines sends the line number i, replaying the earlier lines the printer
+// asks for with "Resend: <n>".
+func (d *Dev) streamLines(ctx context.Context, sent *sentLines, i int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for resends := 0; i <= sent.last; {
+		line, _ := sent.get(i)
+		resp, err := d.send(ctx, line)
+		// Marlin reports the checksum mismatch with an "Error:" line before
+		// the "Resend:" one.
+		var ferr *FirmwareError
+		if errors.As(err, &ferr) {
+			if _, ok := parseResend(ferr.Body); ok {
+				resp, err = ferr.Body, nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if r, ok := parseResend(resp); ok {
+			if _, ok := sent.get(r); !ok || r > i {
+				return fmt.Errorf("printer asked to resend unknown line %d", r)
+			}
+			if resends++; resends > maxResends {
+				return fmt.Errorf("printer asked to resend line %d too many times", r)
+			}
+			log.Printf("StreamGCode: resending from line %d", r)
+			i = r
+			continue
+		}
+		d.trackMode(line)
+		i++
+	}
+	return nil
+}
+
+// withChecksum formats a line with its line number and checksum, which is
+// the XOR of all the bytes before "*".
+func withChecksum(n int, line string) string {
+	out := fmt.Sprintf("N%d %s", n, line)
+	c := byte(0)
+	for i := 0; i < len(out); i++ {
+		c ^= out[i]
+	}
+	return fmt.Sprintf("%s*%d", out, c)
+}
+
+// parseResend returns the line number requested by a "Resend: <n>" reply.
+func parseResend(resp string) (int, bool) {
+	for _, line := range splitLines(resp) {
+		if strings.HasPrefix(line, "Resend:") {
+			n, err := strconv.Atoi(strings.TrimSpace(line[len("Resend:"):]))
+			return n, err == nil
+		}
+	}
+	return 0, false
+}
+
+// packetSize is the amount of file data in each upload packet.
+const packetSize = 4096
+
+// writePackets sends the file data following M28.
+//
+// Each packet is a 16 bytes header followed by packetSize bytes of data, zero
+// padded on the last packet. d.mu must be held.
+func (d *Dev) writePackets(ctx context.Context, r io.Reader, size int64, o *uploadOptions) error {
+	buf := make([]byte, 16+packetSize)
+	sent := int64(0)
+	for i := uint32(0); sent < size; i++ {
+		// Stop on a packet boundary when possible, so the printer parses the
+		// M29 sent by abortUpload as a command.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n := packetSize
+		if size-sent < int64(n) {
+			n = int(size - sent)
+		}
+		if _, err := io.ReadFull(r, buf[16:16+n]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return errors.New("file is shorter than its specified size")
+			}
+			return err
+		}
+		for j := 16 + n; j < len(buf); j++ {
+			buf[j] = 0
+		}
+		binary.BigEndian.PutUint32(buf[0:], 0x5a5aa5a5)
+		binary.BigEndian.PutUint32(buf[4:], i)
+		binary.BigEndian.PutUint32(buf[8:], uint32(n))
+		binary.BigEndian.PutUint32(buf[12:], crc32.ChecksumIEEE(buf[16:16+n]))
+		for b := buf; len(b) != 0; {
+			c := len(b)
+			if o.chunkSize > 0 && c > o.chunkSize {
+				c = o.chunkSize
+			}
+			if err := d.write(ctx, b[:c]); err != nil {
+				return err
+			}
+			b = b[c:]
+			if o.chunkDelay > 0 {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(o.chunkDelay):
+				}
+			}
+		}
+		// The final call is done by the caller once the file is saved.
+		if sent += int64(n); o.progress != nil && sent != size {
+			o.progress(sent, size)
+		}
+	}
+	return nil
+}
+
+// abortUpload closes the file being uploaded after a failed transfer, then
+// deletes it unless keep is true.
+//
+// It uses its own context since the caller's one may be done. d.mu must be
+// held.
+func (d *Dev) abortUpload(path string, keep bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// Discard the replies to the packets sent before the failure.
+	d.drain()
+	if _, err := d.send(ctx, "M29"); err != nil {
+		log.Printf("failed to abort upload: %s", err)
+		return
+	}
+	if keep {
+		return
+	}
+	if _, err := d.send(ctx, "M30 "+path); err != nil {
+		log.Printf("failed to delete partial upload: %s", err)
+	}
+}
+
+// gxMagic is the start of a .gx file, which is a binary header with a preview
+// followed by the G-code.
+const gxMagic = "xgcode 1.0\n"
+
+// validateGCode verifies the leading bytes of a file looks like either text
+// G-code or a .gx file.
+func validateGCode(head []byte) error {
+	if bytes.HasPrefix(head, []byte(gxMagic)) {
+		return nil
+	}
+	for _, c := range head {
+		if c < 0x20 && c != '\t' && c != '\n' && c != '\r' {
+			return errors.New("data is neither G-code nor a .gx file: contains binary data")
+		}
+	}
+	// Look at the first non-empty line.
+	for _, line := range strings.Split(string(head), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		switch line[0] {
+		case ';', '(', 'G', 'M', 'T', 'N', 'g', 'm', 't', 'n':
+			return nil
+		}
+		return fmt.Errorf("data is neither G-code nor a .gx file: starts with %q", line)
+	}
+	return nil
+}
+
+// parseStorage parses a storage report, e.g. "Free: 1024 Total: 4096", the
+// fields possibly on separate lines.
+func parseStorage(resp string) (free, total int64, err error) {
+	hasFree, hasTotal := false, false
+	f := strings.Fields(strings.Join(splitLines(resp), " "))
+	for i := 0; i+1 < len(f); i++ {
+		var dst *int64
+		switch strings.ToLower(f[i]) {
+		case "free:":
+			dst, hasFree = &free, true
+		case "total:":
+			dst, hasTotal = &total, true
+		default:
+			continue
+		}
+		if *dst, err = strconv.ParseInt(f[i+1], 10, 64); err != nil || *dst < 0 {
+			return 0, 0, fmt.Errorf("unknown reply: %q", resp)
+		}
+		i++
+	}
+	if !hasFree || !hasTotal {
+		return 0, 0, ErrUnsupported
+	}
+	if free > total {
+		return 0, 0, fmt.Errorf("unknown reply: %q", resp)
+	}
+	return free, total, nil
+}
+
+// remotePath returns the path of a file stored on the printer.
+func remotePath(name string) string {
+	return "0:/user/" + name
+}
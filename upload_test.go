@@ -0,0 +1,428 @@
+// Copyright 2021 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package ffa3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPrintFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ffa3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "test.gcode")
+	if err := ioutil.WriteFile(p, bytes.Repeat([]byte("G1 X1\n"), 1000), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	if err := d.PrintFile(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"M39", "M28 6000 0:/user/test.gcode", "packet", "packet", "M29", "M23 0:/user/test.gcode"}
+	if got := f.received(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestUploadGCode_Cancel(t *testing.T) {
+	f := newFakePrinter(t)
+	f.packetDelay = 10 * time.Millisecond
+	d := f.connect()
+	f.reset()
+	data := bytes.Repeat([]byte("G1 X1\n"), 4*packetSize/6)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := d.UploadGCode(ctx, "test.gcode", bytes.NewReader(data), int64(len(data)), WithProgress(func(sent, total int64) {
+		cancel()
+	}))
+	if err != context.Canceled {
+		t.Fatal(err)
+	}
+	// The file is closed so the printer doesn't wait for more data, then
+	// deleted.
+	want := []string{"M39", "M28 16380 0:/user/test.gcode", "packet", "M29", "M30 0:/user/test.gcode"}
+	if got := f.received(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	// The partial file can be kept.
+	f.reset()
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	err = d.UploadGCode(ctx, "test.gcode", bytes.NewReader(data), int64(len(data)), WithKeepPartialUpload(), WithProgress(func(sent, total int64) {
+		cancel()
+	}))
+	if err != context.Canceled {
+		t.Fatal(err)
+	}
+	if want := []string{"M39", "M28 16380 0:/user/test.gcode", "packet", "M29"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+}
+
+func TestUploadGCode_CloseFailed(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	// The first M29 fails, the one sent by the abort succeeds.
+	f.set("M29", "Error: write failed", "Done saving file.")
+	data := []byte("G1 X1\n")
+	if err := d.UploadGCode(context.Background(), "test.gcode", bytes.NewReader(data), int64(len(data)), WithSkipStorageCheck()); err == nil {
+		t.Fatal("expected error")
+	}
+	want := []string{"M28 6 0:/user/test.gcode", "packet", "M29", "M29", "M30 0:/user/test.gcode"}
+	if got := f.received(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestValidateGCode(t *testing.T) {
+	data := []struct {
+		in  string
+		err bool
+	}{
+		{"", false},
+		{gxMagic + "\x00\x00\x01", false},
+		{"; generated by slicer\nG28\n", false},
+		{"\r\n\tG28\r\n", false},
+		{"(comment)\n", false},
+		{"m104 S200\n", false},
+		{"N1 G28*18\n", false},
+		{"T0\n", false},
+		{"hello world\n", true},
+		{"G28\x00\x01", true},
+		{"\x89PNG\r\n", true},
+	}
+	for i, line := range data {
+		if err := validateGCode([]byte(line.in)); (err != nil) != line.err {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestUploadGCode_Invalid(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	blob := "\x89PNG\r\n\x1a\n\x00\x00"
+	if err := d.UploadGCode(context.Background(), "test.gcode", strings.NewReader(blob), int64(len(blob))); err == nil {
+		t.Fatal("expected error")
+	}
+	if got := f.received(); len(got) != 0 {
+		t.Fatalf("unexpected commands %q", got)
+	}
+	// The check can be skipped.
+	if err := d.UploadGCode(context.Background(), "test.gcode", strings.NewReader(blob), int64(len(blob)), WithSkipValidation()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"M39", "M28 10 0:/user/test.gcode", "packet", "M29"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+}
+
+func TestUploadGCode_Progress(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	data := bytes.Repeat([]byte("G1 X1\n"), 2000)
+	var progress []int64
+	err := d.UploadGCode(context.Background(), "test.gcode", bytes.NewReader(data), int64(len(data)), WithProgress(func(sent, total int64) {
+		if total != int64(len(data)) {
+			t.Errorf("unexpected total %d", total)
+		}
+		progress = append(progress, sent)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{4096, 8192, 12000}; !reflect.DeepEqual(progress, want) {
+		t.Fatalf("got %v, want %v", progress, want)
+	}
+}
+
+func TestUploadGCode_ChunkSize(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	w := &writeRecorder{Conn: f.client}
+	d.conn = w
+	data := bytes.Repeat([]byte("G1 X1\n"), 1000)
+	if err := d.UploadGCode(context.Background(), "test.gcode", bytes.NewReader(data), int64(len(data)), WithChunkSize(1000, time.Microsecond)); err != nil {
+		t.Fatal(err)
+	}
+	// The M39, M28 and M29 commands are written as a whole.
+	want := []int{len("~M39\n"), len("~M28 6000 0:/user/test.gcode\n"), 1000, 1000, 1000, 1000, 112, 1000, 1000, 1000, 1000, 112, len("~M29\n")}
+	if got := w.writes(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+// writeRecorder records the size of each write.
+type writeRecorder struct {
+	net.Conn
+	mu    sync.Mutex
+	sizes []int
+}
+
+func (w *writeRecorder) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	w.sizes = append(w.sizes, len(b))
+	w.mu.Unlock()
+	return w.Conn.Write(b)
+}
+
+func (w *writeRecorder) writes() []int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]int(nil), w.sizes...)
+}
+
+func TestStreamGCode(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	in := "; header\nG91\n\n  G1 X1 ; move\r\nM105\n"
+	if err := d.StreamGCode(context.Background(), strings.NewReader(in)); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"G91", "G1 X1", "M105"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+	// The positioning mode is tracked.
+	if d.positioning != modeRelative {
+		t.Fatal(d.positioning)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := d.StreamGCode(ctx, strings.NewReader("G28\n")); err == nil || !strings.HasPrefix(err.Error(), "line 1: ") {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamGCode_Checksums(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	l1 := withChecksum(1, "G28")
+	l2 := withChecksum(2, "G1 X1")
+	// The second line is corrupted the first time, the printer asks to resend
+	// from the first one.
+	f.set(l2, "Resend: 1", "")
+	if err := d.StreamGCode(context.Background(), strings.NewReader("G28\nG1 X1\n"), WithChecksums()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"M110 N0", l1, l2, l1, l2}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+	// Marlin prefixes the request with an error line.
+	f.reset()
+	f.set(l2, "Error:checksum mismatch, Last Line: 1\r\nResend: 2", "")
+	if err := d.StreamGCode(context.Background(), strings.NewReader("G28\nG1 X1\n"), WithChecksums()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"M110 N0", l1, l2, l2}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+	// A resend loop is bounded.
+	f.reset()
+	f.set(withChecksum(1, "G28"), "Resend: 1")
+	if err := d.StreamGCode(context.Background(), strings.NewReader("G28\n"), WithChecksums()); err == nil {
+		t.Fatal("expected error")
+	}
+	if got := f.received(); len(got) != 2+maxResends {
+		t.Fatalf("unexpected commands %q", got)
+	}
+	// Only the last resendHistory lines are kept.
+	f.reset()
+	f.set(withChecksum(resendHistory+1, "G1 X1"), "Resend: 1")
+	in := strings.Repeat("G1 X1\n", resendHistory+1)
+	if err := d.StreamGCode(context.Background(), strings.NewReader(in), WithChecksums()); err == nil || !strings.Contains(err.Error(), "unknown line 1") {
+		t.Fatal(err)
+	}
+}
+
+func TestSentLines(t *testing.T) {
+	s := sentLines{}
+	if _, ok := s.get(0); ok {
+		t.Fatal("expected empty")
+	}
+	for i := 1; i <= resendHistory+2; i++ {
+		if n := s.add("G28"); n != i {
+			t.Fatalf("got %d, want %d", n, i)
+		}
+	}
+	data := []struct {
+		n  int
+		ok bool
+	}{
+		{0, false},
+		// The oldest lines were dropped.
+		{1, false},
+		{2, false},
+		{3, true},
+		{resendHistory + 2, true},
+		{resendHistory + 3, false},
+	}
+	for i, line := range data {
+		got, ok := s.get(line.n)
+		if ok != line.ok || (ok && got != withChecksum(line.n, "G28")) {
+			t.Fatalf("#%d: get(%d) = %q, %t", i, line.n, got, ok)
+		}
+	}
+}
+
+func TestGCodeWriter(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	w := d.GCodeWriter(context.Background())
+	// The writes are not aligned on lines.
+	for _, s := range []string{"G2", "8\nG1 X", "1\n; comment\nM105"} {
+		if _, err := io.WriteString(w, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"G28", "G1 X1", "M105"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+
+	// The streaming error is returned.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w = d.GCodeWriter(ctx)
+	io.WriteString(w, "G28\n")
+	if err := w.Close(); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestWithChecksum(t *testing.T) {
+	if got := withChecksum(12, "M105"); got != "N12 M105*20" {
+		t.Fatal(got)
+	}
+	if got := commandCode("N12 M105*20"); got != "M105" {
+		t.Fatal(got)
+	}
+	if got := commandCode("N12*5"); got != "N12" {
+		t.Fatal(got)
+	}
+	if got := commandCode("G1 X1"); got != "G1" {
+		t.Fatal(got)
+	}
+	data := []struct {
+		in   string
+		n    int
+		want bool
+	}{
+		{"Resend: 3", 3, true},
+		{"Error:checksum mismatch\r\nResend:4", 4, true},
+		{"Resend: x", 0, false},
+		{"", 0, false},
+	}
+	for i, line := range data {
+		if n, ok := parseResend(line.in); n != line.n || ok != line.want {
+			t.Fatalf("#%d: got %d %t", i, n, ok)
+		}
+	}
+}
+
+func TestParseStorage(t *testing.T) {
+	data := []struct {
+		in          string
+		free, total int64
+		err         error
+	}{
+		{in: "Free: 1024 Total: 4096", free: 1024, total: 4096},
+		{in: "free: 1\r\ntotal: 2", free: 1, total: 2},
+		{in: "Files: 3", err: ErrUnsupported},
+		{in: "Free: 1024", err: ErrUnsupported},
+	}
+	for i, line := range data {
+		free, total, err := parseStorage(line.in)
+		if err != line.err || free != line.free || total != line.total {
+			t.Fatalf("#%d: got %d %d %v", i, free, total, err)
+		}
+	}
+	for _, in := range []string{"Free: x Total: 2", "Free: -1 Total: 2", "Free: 3 Total: 2"} {
+		if _, _, err := parseStorage(in); err == nil || err == ErrUnsupported {
+			t.Fatalf("%q: unexpected error %v", in, err)
+		}
+	}
+}
+
+func TestStorageInfo(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	f.set("M39", "Free: 1024 Total: 4096")
+	if free, total, err := d.StorageInfo(); err != nil || free != 1024 || total != 4096 {
+		t.Fatal(free, total, err)
+	}
+	if want := []string{"M39"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+}
+
+func TestUploadGCode_Storage(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	f.set("M39", "Free: 3 Total: 4096")
+	err := d.UploadGCode(context.Background(), "test.gcode", strings.NewReader("G28\n"), 4)
+	if !errors.Is(err, ErrInsufficientStorage) {
+		t.Fatal(err)
+	}
+	if want := []string{"M39"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+	// The check can be skipped.
+	f.reset()
+	if err := d.UploadGCode(context.Background(), "test.gcode", strings.NewReader("G28\n"), 4, WithSkipStorageCheck()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"M28 4 0:/user/test.gcode", "packet", "M29"}; !reflect.DeepEqual(f.received(), want) {
+		t.Fatalf("got %q, want %q", f.received(), want)
+	}
+}
+
+func TestReprint(t *testing.T) {
+	f := newFakePrinter(t)
+	d := f.connect()
+	f.reset()
+	if err := d.Reprint(); err == nil {
+		t.Fatal("expected error")
+	}
+	// The file reported by the printer is used first.
+	f.set("M27", "Current file: 0:/user/benchy.gx\r\nSD printing byte 0/100")
+	if err := d.Reprint(); err != nil {
+		t.Fatal(err)
+	}
+	// Then the last one started.
+	f.set("M27", "SD printing byte 0/0")
+	if err := d.Reprint(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"M27", "M27", "M23 0:/user/benchy.gx", "M27", "M23 0:/user/benchy.gx"}
+	if got := f.received(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}